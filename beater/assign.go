@@ -0,0 +1,195 @@
+package beater
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Consumer of static partition assignment (mode: assign)
+//
+// Partitions are consumed without group coordination, offsets are stored
+// in the local registry file instead of being committed to Kafka.
+type staticConsumer struct {
+	client     sarama.Client
+	consumer   sarama.Consumer
+	registrar  *registrar
+	partitions []sarama.PartitionConsumer
+
+	messages chan *sarama.ConsumerMessage
+	errors   chan error
+	closing  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Partitions to consume, all partitions of topics if no partitions are given
+func staticPartitions(client sarama.Client, partitions map[string][]int32, topics []string) (map[string][]int32, error) {
+	if len(partitions) > 0 {
+		return partitions, nil
+	}
+
+	partitions = map[string][]int32{}
+	for _, topic := range topics {
+		list, err := client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch partitions of topic: %s, %v", topic, err)
+		}
+		partitions[topic] = list
+	}
+	return partitions, nil
+}
+
+// Offsets to consume partitions from: registry offset, initial offset if
+// partition is not in registry or force_initial_offset is set
+func resolveStaticOffsets(
+	client sarama.Client,
+	partitions map[string][]int32,
+	registrar *registrar,
+	initial *initialOffset,
+	force bool,
+) (map[topicPartition]int64, error) {
+	offsets := map[topicPartition]int64{}
+	for topic, list := range partitions {
+		for _, partition := range list {
+			offset, exists := registrar.Offset(topic, partition)
+			if !exists || force {
+				var err error
+				if offset, err = initial.Resolve(client, topic, partition); err != nil {
+					return nil, fmt.Errorf("failed to resolve initial offset of topic: %s, partition: %d, %v", topic, partition, err)
+				}
+			}
+			offsets[topicPartition{topic, partition}] = offset
+		}
+	}
+	return offsets, nil
+}
+
+// Starts consuming partitions from given offsets. Partitions with offset out
+// of range, e.g. removed by retention, are consumed from initial position.
+// Consumer takes ownership of client and registrar, both are closed on error.
+func newStaticConsumer(
+	client sarama.Client,
+	offsets map[topicPartition]int64,
+	registrar *registrar,
+	position int64,
+	logger *logp.Logger,
+) (*staticConsumer, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		registrar.Close()
+		client.Close()
+		return nil, err
+	}
+
+	c := &staticConsumer{
+		client:    client,
+		consumer:  consumer,
+		registrar: registrar,
+		messages:  make(chan *sarama.ConsumerMessage, client.Config().ChannelBufferSize),
+		errors:    make(chan error, client.Config().ChannelBufferSize),
+		closing:   make(chan struct{}),
+	}
+
+	for _, tp := range sortedPartitions(offsets) {
+		offset := offsets[tp]
+		pc, err := consumer.ConsumePartition(tp.topic, tp.partition, offset)
+		if err == sarama.ErrOffsetOutOfRange {
+			logger.Warnf("topic: %s, partition: %d, offset %d out of range, consuming from initial offset",
+				tp.topic, tp.partition, offset)
+			pc, err = consumer.ConsumePartition(tp.topic, tp.partition, position)
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to consume topic: %s, partition: %d, %v", tp.topic, tp.partition, err)
+		}
+		logger.Infof("consuming topic: %s, partition: %d, offset: %d", tp.topic, tp.partition, offset)
+
+		c.partitions = append(c.partitions, pc)
+		c.wg.Add(2)
+		go c.forwardMessages(pc)
+		go c.forwardErrors(pc)
+	}
+	return c, nil
+}
+
+func (c *staticConsumer) forwardMessages(pc sarama.PartitionConsumer) {
+	defer c.wg.Done()
+	for msg := range pc.Messages() {
+		select {
+		case c.messages <- msg:
+		case <-c.closing:
+		}
+	}
+}
+
+func (c *staticConsumer) forwardErrors(pc sarama.PartitionConsumer) {
+	defer c.wg.Done()
+	for err := range pc.Errors() {
+		select {
+		case c.errors <- err:
+		case <-c.closing:
+		}
+	}
+}
+
+func (c *staticConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func (c *staticConsumer) Errors() <-chan error {
+	return c.errors
+}
+
+// No rebalancing without consumer group
+func (c *staticConsumer) Notifications() <-chan *cluster.Notification {
+	return nil
+}
+
+// Marks message offset as processed
+func (c *staticConsumer) MarkPartitionOffset(topic string, partition int32, offset int64, _ string) {
+	c.registrar.Mark(topic, partition, offset+1)
+}
+
+// Writes registry file
+func (c *staticConsumer) CommitOffsets() error {
+	return c.registrar.Flush()
+}
+
+// Stops partition consumers and writes final offsets to registry file
+func (c *staticConsumer) Close() error {
+	close(c.closing)
+	for _, pc := range c.partitions {
+		pc.AsyncClose()
+	}
+	c.wg.Wait()
+	close(c.messages)
+	close(c.errors)
+
+	err := c.consumer.Close()
+	if regErr := c.registrar.Close(); regErr != nil {
+		err = regErr
+	}
+	if clientErr := c.client.Close(); clientErr != nil && err == nil {
+		err = clientErr
+	}
+	return err
+}
+
+func sortedPartitions(offsets map[topicPartition]int64) []topicPartition {
+	list := make([]topicPartition, 0, len(offsets))
+	for tp := range offsets {
+		list = append(list, tp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].topic != list[j].topic {
+			return list[i].topic < list[j].topic
+		}
+		return list[i].partition < list[j].partition
+	})
+	return list
+}
@@ -0,0 +1,194 @@
+// +build !integration
+
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+func TestAssignConfig(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"mode":       "assign",
+		"partitions": map[string]interface{}{"orders": []int{0, 3}},
+	})
+	if expected := map[string][]int32{"orders": {0, 3}}; !reflect.DeepEqual(bt.bConfig.Partitions, expected) {
+		t.Errorf("Expected partitions %v, found %v", expected, bt.bConfig.Partitions)
+	}
+
+	for _, settings := range []map[string]interface{}{
+		{"mode": "assign", "topics": []interface{}{map[string]interface{}{"pattern": "^orders"}}},
+		{"mode": "static", "partitions": map[string]interface{}{"orders": []int{0}}},
+		{"partitions": map[string]interface{}{"orders": []int{0}}},
+		{"mode": "assign", "topics_pattern": "^orders", "partitions": map[string]interface{}{"orders": []int{0}}},
+	} {
+		cfg, err := common.NewConfigFrom(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("Error expected for %v", settings)
+		}
+	}
+}
+
+func TestStaticPartitions(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("orders", 1, broker.BrokerID()).
+			SetLeader("audit", 0, broker.BrokerID()),
+	})
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// all partitions of topics, without group ACLs
+	partitions, err := staticPartitions(client, nil, []string{"orders", "audit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string][]int32{"orders": {0, 1}, "audit": {0}}; !reflect.DeepEqual(partitions, expected) {
+		t.Errorf("Expected partitions %v, found %v", expected, partitions)
+	}
+
+	given := map[string][]int32{"orders": {1}}
+	if partitions, _ := staticPartitions(client, given, []string{"orders"}); !reflect.DeepEqual(partitions, given) {
+		t.Errorf("Expected given partitions %v, found %v", given, partitions)
+	}
+}
+
+func TestStaticConsumer(t *testing.T) {
+	path, cleanup := newTestRegistryPath(t)
+	defer cleanup()
+
+	r, err := newRegistrar(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Mark("orders", 0, 10)
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("orders", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetOldest, 0).
+			SetOffset("orders", 0, sarama.OffsetNewest, 11).
+			SetOffset("orders", 1, sarama.OffsetOldest, 5).
+			SetOffset("orders", 1, sarama.OffsetNewest, 6),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).
+			SetMessage("orders", 0, 10, sarama.StringEncoder("ten")).
+			SetMessage("orders", 1, 5, sarama.StringEncoder("five")),
+	})
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// partition 0 from registry, partition 1 from oldest
+	initial, _ := parseInitialOffset("oldest")
+	partitions := map[string][]int32{"orders": {0, 1}}
+	offsets, err := resolveStaticOffsets(client, partitions, r, initial, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[topicPartition]int64{{"orders", 0}: 10, {"orders", 1}: 5}
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Fatalf("Expected offsets %v, found %v", expected, offsets)
+	}
+
+	c, err := newStaticConsumer(client, offsets, r, initial.position, logp.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-c.Messages():
+			if msg.Offset != offsets[topicPartition{msg.Topic, msg.Partition}] {
+				t.Errorf("Unexpected message of partition %d, offset %d", msg.Partition, msg.Offset)
+			}
+			c.MarkPartitionOffset(msg.Topic, msg.Partition, msg.Offset, "")
+		case err := <-c.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for messages")
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// offsets of next messages are written on close
+	r, err = newRegistrar(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for tp, offset := range map[topicPartition]int64{{"orders", 0}: 11, {"orders", 1}: 6} {
+		if found, _ := r.Offset(tp.topic, tp.partition); found != offset {
+			t.Errorf("Expected registry offset %d of partition %d, found %d", offset, tp.partition, found)
+		}
+	}
+
+	// registry is ignored with force_initial_offset
+	r.Mark("orders", 1, 6)
+	client, err = sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	offsets, err = resolveStaticOffsets(client, partitions, r, initial, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[topicPartition]int64{{"orders", 0}: 0, {"orders", 1}: 5}; !reflect.DeepEqual(offsets, expected) {
+		t.Errorf("Expected offsets %v, found %v", expected, offsets)
+	}
+}
+
+func TestStaticConsumerClosedOnError(t *testing.T) {
+	path, cleanup := newTestRegistryPath(t)
+	defer cleanup()
+
+	r, err := newRegistrar(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close() // consumer can not be created from closed client
+
+	if _, err := newStaticConsumer(client, nil, r, sarama.OffsetOldest, logp.NewLogger("test")); err == nil {
+		t.Fatal("Error expected for closed client")
+	}
+	select {
+	case <-r.done:
+	default:
+		t.Error("Registrar expected to be closed on error")
+	}
+}
+
@@ -0,0 +1,400 @@
+package beater
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Avro schema
+//
+// Parsed schema drives decoding of Avro binary encoding straight into event
+// fields: records and maps become common.MapStr, unions are unwrapped to the
+// value of the selected branch, enums become symbol strings. Logical types
+// date, timestamp-millis and timestamp-micros are decoded as common.Time,
+// decimal as exact decimal string, other logical types as underlying type.
+type avroSchema struct {
+	typ     string // primitive type name, record, enum, array, map, fixed or union
+	logical string
+	name    string // full name of named types
+
+	fields   []avroField   // record
+	symbols  []string      // enum
+	items    *avroSchema   // array items, map values
+	branches []*avroSchema // union
+	size     int           // fixed
+	scale    int           // decimal
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// Parses Avro schema in JSON form
+func parseAvroSchema(schema string) (*avroSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(schema), &v); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %v", err)
+	}
+
+	p := &avroParser{names: map[string]*avroSchema{}}
+	return p.parse(v, "")
+}
+
+// Named types registry, names are resolved in order of definition
+type avroParser struct {
+	names map[string]*avroSchema
+}
+
+func (p *avroParser) parse(v interface{}, namespace string) (*avroSchema, error) {
+	switch s := v.(type) {
+	case string:
+		return p.lookup(s, namespace)
+	case []interface{}:
+		return p.parseUnion(s, namespace)
+	case map[string]interface{}:
+		return p.parseComplex(s, namespace)
+	default:
+		return nil, fmt.Errorf("invalid avro schema: %v", v)
+	}
+}
+
+func (p *avroParser) lookup(name, namespace string) (*avroSchema, error) {
+	if avroPrimitives[name] {
+		return &avroSchema{typ: name}, nil
+	}
+	if s, exists := p.names[avroFullName(name, namespace)]; exists {
+		return s, nil
+	}
+	if s, exists := p.names[name]; exists {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown avro type: '%s'", name)
+}
+
+func (p *avroParser) parseUnion(branches []interface{}, namespace string) (*avroSchema, error) {
+	s := &avroSchema{typ: "union"}
+	for _, b := range branches {
+		branch, err := p.parse(b, namespace)
+		if err != nil {
+			return nil, err
+		}
+		s.branches = append(s.branches, branch)
+	}
+	return s, nil
+}
+
+func (p *avroParser) parseComplex(m map[string]interface{}, namespace string) (*avroSchema, error) {
+	typ, ok := m["type"].(string)
+	if !ok {
+		// type is itself a schema, e.g. {"type": {"type": "array", ...}}
+		if t, exists := m["type"]; exists {
+			return p.parse(t, namespace)
+		}
+		return nil, fmt.Errorf("avro schema type missing: %v", m)
+	}
+
+	s := &avroSchema{typ: typ}
+	s.logical, _ = m["logicalType"].(string)
+
+	switch typ {
+	case "record", "error", "enum", "fixed":
+		name, _ := m["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("avro %s name missing", typ)
+		}
+		if ns, ok := m["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		s.name = avroFullName(name, namespace)
+		if i := strings.LastIndex(s.name, "."); i >= 0 {
+			namespace = s.name[:i]
+		}
+		p.names[s.name] = s // registered before fields for recursive types
+	}
+
+	switch typ {
+	case "record", "error":
+		s.typ = "record"
+		fields, _ := m["fields"].([]interface{})
+		for _, f := range fields {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid avro field in record %s", s.name)
+			}
+			name, _ := fm["name"].(string)
+			schema, err := p.parse(fm["type"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			s.fields = append(s.fields, avroField{name: name, schema: schema})
+		}
+
+	case "enum":
+		symbols, _ := m["symbols"].([]interface{})
+		for _, sym := range symbols {
+			name, _ := sym.(string)
+			s.symbols = append(s.symbols, name)
+		}
+
+	case "array", "map":
+		key := "items"
+		if typ == "map" {
+			key = "values"
+		}
+		items, err := p.parse(m[key], namespace)
+		if err != nil {
+			return nil, err
+		}
+		s.items = items
+
+	case "fixed":
+		size, _ := m["size"].(float64)
+		s.size = int(size)
+
+	default:
+		if !avroPrimitives[typ] {
+			return p.lookup(typ, namespace)
+		}
+	}
+
+	if s.logical == "decimal" {
+		scale, _ := m["scale"].(float64)
+		s.scale = int(scale)
+	}
+	return s, nil
+}
+
+func avroFullName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// Decodes Avro binary encoded datum
+func (s *avroSchema) Decode(data []byte) (interface{}, error) {
+	r := &avroReader{data: data}
+	v := r.read(s)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return v, nil
+}
+
+var errAvroShortBuffer = errors.New("avro datum is truncated")
+
+// Maximum number of array items taking no bytes (nulls, empty records) per
+// datum, bounds memory of decoding a forged item count
+const avroMaxEmptyItems = 1 << 20
+
+// Binary decoder, first error stops decoding
+type avroReader struct {
+	data  []byte
+	err   error
+	empty int // array items taking no bytes
+}
+
+func (r *avroReader) read(s *avroSchema) interface{} {
+	if r.err != nil {
+		return nil
+	}
+
+	switch s.typ {
+	case "null":
+		return nil
+	case "boolean":
+		b := r.next(1)
+		return b != nil && b[0] != 0
+	case "int":
+		v := int32(r.long())
+		if s.logical == "date" {
+			return common.Time(time.Unix(int64(v)*86400, 0).UTC())
+		}
+		return v
+	case "long":
+		v := r.long()
+		switch s.logical {
+		case "timestamp-millis":
+			return common.Time(time.Unix(0, v*int64(time.Millisecond)).UTC())
+		case "timestamp-micros":
+			return common.Time(time.Unix(0, v*int64(time.Microsecond)).UTC())
+		}
+		return v
+	case "float":
+		if b := r.next(4); b != nil {
+			return math.Float32frombits(binary.LittleEndian.Uint32(b))
+		}
+	case "double":
+		if b := r.next(8); b != nil {
+			return math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+	case "bytes":
+		b := r.bytes()
+		if s.logical == "decimal" {
+			return avroDecimal(b, s.scale)
+		}
+		return b
+	case "string":
+		return string(r.bytes())
+	case "fixed":
+		b := r.next(s.size)
+		if s.logical == "decimal" {
+			return avroDecimal(b, s.scale)
+		}
+		return b
+	case "enum":
+		i := r.long()
+		if i < 0 || i >= int64(len(s.symbols)) {
+			r.fail(fmt.Errorf("avro enum %s index %d out of range", s.name, i))
+			return nil
+		}
+		return s.symbols[i]
+	case "union":
+		i := r.long()
+		if i < 0 || i >= int64(len(s.branches)) {
+			r.fail(fmt.Errorf("avro union index %d out of range", i))
+			return nil
+		}
+		return r.read(s.branches[i])
+	case "record":
+		fields := common.MapStr{}
+		for _, f := range s.fields {
+			fields[f.name] = r.read(f.schema)
+		}
+		return fields
+	case "array":
+		items := []interface{}{}
+		r.blocks(func(n int) {
+			items = append(make([]interface{}, 0, len(items)+n), items...)
+		}, func() {
+			size := len(r.data)
+			items = append(items, r.read(s.items))
+			if size == len(r.data) {
+				if r.empty++; r.empty > avroMaxEmptyItems {
+					r.fail(fmt.Errorf("avro array exceeds %d items without data", avroMaxEmptyItems))
+				}
+			}
+		})
+		return items
+	case "map":
+		values := common.MapStr{}
+		r.blocks(nil, func() {
+			key := string(r.bytes())
+			values[key] = r.read(s.items)
+		})
+		return values
+	default:
+		r.fail(fmt.Errorf("unsupported avro type: '%s'", s.typ))
+	}
+	return nil
+}
+
+// Array and map blocks, negative count is followed by block size in bytes.
+// Items may take no bytes (nulls, empty records), so the count is not bound
+// by remaining data, preallocation of grow is capped by it instead.
+func (r *avroReader) blocks(grow func(n int), item func()) {
+	for r.err == nil {
+		n := r.long()
+		if n == 0 {
+			return
+		}
+		if n < 0 {
+			n = -n
+			r.long()
+		}
+		if grow != nil {
+			if n < int64(len(r.data)) {
+				grow(int(n))
+			} else {
+				grow(len(r.data))
+			}
+		}
+		for ; n > 0 && r.err == nil; n-- {
+			item()
+		}
+	}
+}
+
+// Zig-zag encoded variable length integer
+func (r *avroReader) long() int64 {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b := r.next(1)
+		if b == nil {
+			return 0
+		}
+		v |= uint64(b[0]&0x7f) << shift
+		if b[0]&0x80 == 0 {
+			return int64(v>>1) ^ -int64(v&1)
+		}
+	}
+	r.fail(errors.New("avro varint overflow"))
+	return 0
+}
+
+func (r *avroReader) bytes() []byte {
+	n := r.long()
+	if n < 0 {
+		r.fail(fmt.Errorf("avro negative length %d", n))
+		return nil
+	}
+	if n > int64(len(r.data)) {
+		r.fail(errAvroShortBuffer)
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *avroReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.fail(errAvroShortBuffer)
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *avroReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Two's-complement big-endian unscaled value rendered as exact decimal string
+func avroDecimal(b []byte, scale int) string {
+	n := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	if scale <= 0 {
+		return n.String()
+	}
+
+	digits := new(big.Int).Abs(n).String()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	s := digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	if n.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,253 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Minimal Avro binary encoder for test data
+type testAvroWriter struct {
+	buf []byte
+}
+
+func (w *testAvroWriter) long(v int64) *testAvroWriter {
+	u := uint64((v << 1) ^ (v >> 63))
+	for u >= 0x80 {
+		w.buf = append(w.buf, byte(u)|0x80)
+		u >>= 7
+	}
+	w.buf = append(w.buf, byte(u))
+	return w
+}
+
+func (w *testAvroWriter) bytes(b []byte) *testAvroWriter {
+	w.long(int64(len(b)))
+	w.buf = append(w.buf, b...)
+	return w
+}
+
+func (w *testAvroWriter) str(s string) *testAvroWriter {
+	return w.bytes([]byte(s))
+}
+
+func (w *testAvroWriter) double(f float64) *testAvroWriter {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+	w.buf = append(w.buf, b...)
+	return w
+}
+
+func (w *testAvroWriter) boolean(b bool) *testAvroWriter {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+	return w
+}
+
+const testAvroSchema = `{
+  "type": "record",
+  "name": "Order",
+  "namespace": "com.example",
+  "fields": [
+    {"name": "id", "type": "long"},
+    {"name": "@timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "customer", "type": {
+      "type": "record",
+      "name": "Customer",
+      "fields": [
+        {"name": "name", "type": "string"},
+        {"name": "vip", "type": "boolean"}
+      ]
+    }},
+    {"name": "referrer", "type": ["null", "Customer"]},
+    {"name": "note", "type": ["null", "string"]},
+    {"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "PAID"]}},
+    {"name": "items", "type": {"type": "array", "items": "string"}},
+    {"name": "attributes", "type": {"type": "map", "values": "double"}},
+    {"name": "total", "type": {"type": "bytes", "logicalType": "decimal", "precision": 9, "scale": 2}},
+    {"name": "shipped", "type": {"type": "int", "logicalType": "date"}},
+    {"name": "checksum", "type": {"type": "fixed", "name": "MD5", "size": 2}}
+  ]
+}`
+
+func newTestAvroOrder() []byte {
+	w := &testAvroWriter{}
+	w.long(42)
+	w.long(1556298970945)
+	w.str("acme").boolean(true)
+	w.long(0)
+	w.long(1).str("gift")
+	w.long(1)
+	w.long(2).str("book").str("pen").long(0)
+	w.long(-1).long(14).str("weight").double(1.5).long(0)
+	w.bytes([]byte{0xfe, 0x0c}) // -500
+	w.long(18012)
+	w.buf = append(w.buf, 0xca, 0xfe)
+	return w.buf
+}
+
+func TestAvroDecode(t *testing.T) {
+	schema, err := parseAvroSchema(testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := schema.Decode(newTestAvroOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := common.MapStr{
+		"id":         int64(42),
+		"@timestamp": common.Time(time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC)),
+		"customer":   common.MapStr{"name": "acme", "vip": true},
+		"referrer":   nil,
+		"note":       "gift",
+		"status":     "PAID",
+		"items":      []interface{}{"book", "pen"},
+		"attributes": common.MapStr{"weight": 1.5},
+		"total":      "-5.00",
+		"shipped":    common.Time(time.Date(2019, time.April, 26, 0, 0, 0, 0, time.UTC)),
+		"checksum":   []byte{0xca, 0xfe},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", v)
+	}
+}
+
+func TestAvroDecodeRecursive(t *testing.T) {
+	schema, err := parseAvroSchema(`{
+	  "type": "record", "name": "Node",
+	  "fields": [
+	    {"name": "value", "type": "int"},
+	    {"name": "next", "type": ["null", "Node"]}
+	  ]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testAvroWriter{}
+	w.long(1).long(1).long(2).long(0)
+	v, err := schema.Decode(w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := common.MapStr{
+		"value": int32(1),
+		"next":  common.MapStr{"value": int32(2), "next": nil},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", v)
+	}
+}
+
+func TestAvroDecodeInvalid(t *testing.T) {
+	schema, err := parseAvroSchema(testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestAvroOrder()
+	for _, data := range [][]byte{
+		order[:len(order)-1],
+		{0x54, 0x02},             // truncated record
+		{0xff, 0xff, 0xff, 0xff}, // truncated varint
+	} {
+		if _, err := schema.Decode(data); err == nil {
+			t.Errorf("Error expected for %v", data)
+		}
+	}
+}
+
+func TestAvroDecodeEmptyItems(t *testing.T) {
+	schema, err := parseAvroSchema(`{
+	  "type": "record", "name": "Batch",
+	  "fields": [
+	    {"name": "nulls", "type": {"type": "array", "items": "null"}},
+	    {"name": "markers", "type": {"type": "array", "items":
+	      {"type": "record", "name": "Marker", "fields": []}}},
+	    {"name": "missing", "type": {"type": "map", "values": "null"}}
+	  ]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// item counts exceed remaining data, items take no bytes
+	w := &testAvroWriter{}
+	w.long(5).long(0)
+	w.long(-3).long(0).long(0)
+	w.long(1).bytes([]byte("a")).long(0)
+	v, err := schema.Decode(w.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := common.MapStr{
+		"nulls":   []interface{}{nil, nil, nil, nil, nil},
+		"markers": []interface{}{common.MapStr{}, common.MapStr{}, common.MapStr{}},
+		"missing": common.MapStr{"a": nil},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", v)
+	}
+
+	// forged count of empty items
+	w = &testAvroWriter{}
+	w.long(math.MaxInt64).long(0).long(0).long(0)
+	if _, err := schema.Decode(w.buf); err == nil {
+		t.Error("Error expected for forged item count")
+	}
+
+	// truncated map
+	w = &testAvroWriter{}
+	w.long(0).long(0).long(3).bytes([]byte("a"))
+	if _, err := schema.Decode(w.buf); err == nil {
+		t.Error("Error expected for truncated map")
+	}
+}
+
+func TestAvroParseInvalidSchema(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "A", "fields": [{"name": "b", "type": "Unknown"}]}`,
+		`not json`,
+	} {
+		if _, err := parseAvroSchema(schema); err == nil {
+			t.Errorf("Error expected for %s", schema)
+		}
+	}
+}
+
+func TestAvroDecimal(t *testing.T) {
+	cases := []struct {
+		unscaled []byte
+		scale    int
+		expected string
+	}{
+		{[]byte{0x30, 0x39}, 2, "123.45"},
+		{[]byte{0x05}, 3, "0.005"},
+		{[]byte{0xff}, 1, "-0.1"},
+		{[]byte{0x01, 0x00}, 0, "256"},
+	}
+
+	for _, c := range cases {
+		if s := avroDecimal(c.unscaled, c.scale); s != c.expected {
+			t.Errorf("Expected %s, found %s", c.expected, s)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package beater
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// Bounded consumption of run_once mode
+//
+// End offsets of subscribed partitions are snapshotted on startup, messages
+// at or after end offset are skipped. Consumption is finished once offsets
+// of all assigned partitions are committed up to their end offsets.
+// Offsets right before end offset may never be delivered (transaction
+// markers, compacted records), so partition is finished as well once
+// a message at or after end offset is fetched and all messages fetched
+// before it are committed. Partitions of topics created after startup
+// are not consumed.
+type backfill struct {
+	mu       sync.Mutex
+	ends     map[topicPartition]int64 // exclusive
+	next     map[topicPartition]int64 // next offset to consume
+	fetched  map[topicPartition]int64 // offset after last fetched message before end
+	reached  map[topicPartition]bool  // message at or after end was fetched
+	assigned map[string][]int32       // nil until first assignment
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newBackfill() *backfill {
+	return &backfill{
+		ends:    map[topicPartition]int64{},
+		next:    map[topicPartition]int64{},
+		fetched: map[topicPartition]int64{},
+		reached: map[topicPartition]bool{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Snapshots end offsets of partitions, end offset is given by until: newest
+// offset or offset of first message at or after timestamp. Partitions are
+// consumed from committed offset, initial offset if there is none.
+func snapshotBackfill(
+	client sarama.Client,
+	group string,
+	topics []string,
+	initial *initialOffset,
+	until *initialOffset,
+) (*backfill, error) {
+	om, err := sarama.NewOffsetManagerFromClient(group, client)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBackfill()
+	var poms []sarama.PartitionOffsetManager
+	snapshot := func() error {
+		for _, topic := range topics {
+			list, err := client.Partitions(topic)
+			if err != nil {
+				return err
+			}
+			for _, partition := range list {
+				pom, err := om.ManagePartition(topic, partition)
+				if err != nil {
+					return err
+				}
+				poms = append(poms, pom)
+
+				start, _ := pom.NextOffset()
+				if start < 0 {
+					if start, err = initial.Resolve(client, topic, partition); err != nil {
+						return fmt.Errorf("failed to resolve initial offset of topic: %s, partition: %d, %v", topic, partition, err)
+					}
+				}
+				end, err := until.Resolve(client, topic, partition)
+				if err != nil {
+					return fmt.Errorf("failed to resolve end offset of topic: %s, partition: %d, %v", topic, partition, err)
+				}
+				b.Set(topic, partition, start, end)
+			}
+		}
+		return nil
+	}
+	err = snapshot()
+
+	om.Close()
+	for _, pom := range poms {
+		pom.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Sets offset partition is consumed from and end offset
+func (b *backfill) Set(topic string, partition int32, start, end int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tp := topicPartition{topic, partition}
+	b.next[tp] = start
+	b.ends[tp] = end
+}
+
+// Whether message is past end offset of its partition
+func (b *backfill) Skip(msg *sarama.ConsumerMessage) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tp := topicPartition{msg.Topic, msg.Partition}
+	end, exists := b.ends[tp]
+	if !exists {
+		return true
+	}
+	if msg.Offset < end {
+		if msg.Offset+1 > b.fetched[tp] {
+			b.fetched[tp] = msg.Offset + 1
+		}
+		return false
+	}
+	if !b.reached[tp] {
+		b.reached[tp] = true
+		b.check()
+	}
+	return true
+}
+
+// Records committed message offset
+func (b *backfill) Commit(topic string, partition int32, offset int64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tp := topicPartition{topic, partition}
+	if offset+1 > b.next[tp] {
+		b.next[tp] = offset + 1
+	}
+	b.check()
+}
+
+// Sets partitions currently assigned to consumer
+func (b *backfill) Assign(current map[string][]int32) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.assigned = current
+	if b.assigned == nil {
+		b.assigned = map[string][]int32{}
+	}
+	b.check()
+}
+
+// Number of messages left to consume up to end offsets
+func (b *backfill) Pending() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int64
+	for tp, end := range b.ends {
+		if end > b.next[tp] {
+			n += end - b.next[tp]
+		}
+	}
+	return n
+}
+
+// Closed once assigned partitions are consumed up to end offsets,
+// nil channel outside of run_once mode
+func (b *backfill) Done() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.done
+}
+
+func (b *backfill) check() {
+	// partitions with end offset reached and nothing in-flight are finished
+	for tp := range b.reached {
+		if b.next[tp] >= b.fetched[tp] && b.next[tp] < b.ends[tp] {
+			b.next[tp] = b.ends[tp]
+		}
+	}
+
+	if b.assigned == nil {
+		return
+	}
+	for topic, list := range b.assigned {
+		for _, partition := range list {
+			tp := topicPartition{topic, partition}
+			if end, exists := b.ends[tp]; exists && b.next[tp] < end {
+				return
+			}
+		}
+	}
+	b.doneOnce.Do(func() { close(b.done) })
+}
@@ -0,0 +1,171 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func isDone(b *backfill) bool {
+	select {
+	case <-b.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	b := newBackfill()
+	b.Set("logs", 0, 5, 10)
+	b.Set("logs", 1, 3, 3) // nothing to consume
+	b.Set("audit", 0, 0, 2)
+
+	for _, test := range []struct {
+		msg  sarama.ConsumerMessage
+		skip bool
+	}{
+		{sarama.ConsumerMessage{Topic: "logs", Partition: 0, Offset: 9}, false},
+		{sarama.ConsumerMessage{Topic: "logs", Partition: 0, Offset: 10}, true},
+		{sarama.ConsumerMessage{Topic: "logs", Partition: 1, Offset: 3}, true},
+		{sarama.ConsumerMessage{Topic: "logs", Partition: 2, Offset: 0}, true},
+	} {
+		if skip := b.Skip(&test.msg); skip != test.skip {
+			t.Errorf("Expected skip %v for partition %d offset %d", test.skip, test.msg.Partition, test.msg.Offset)
+		}
+	}
+	if n := b.Pending(); n != 7 {
+		t.Errorf("Expected 7 pending messages, found %d", n)
+	}
+
+	// not done before partitions are assigned
+	b.Commit("logs", 0, 9)
+	if isDone(b) {
+		t.Fatal("Unexpected done before assignment")
+	}
+
+	// audit is consumed by another group member
+	b.Assign(map[string][]int32{"logs": {0, 1, 2}, "audit": {0}})
+	if isDone(b) {
+		t.Fatal("Unexpected done with audit partition pending")
+	}
+	b.Assign(map[string][]int32{"logs": {0, 1, 2}})
+	if !isDone(b) {
+		t.Fatal("Expected done once assigned partitions are consumed")
+	}
+
+	// nil backfill outside of run_once
+	var none *backfill
+	if none.Skip(&sarama.ConsumerMessage{}) || none.Done() != nil {
+		t.Error("Unexpected nil backfill behaviour")
+	}
+	none.Commit("logs", 0, 1)
+	none.Assign(nil)
+}
+
+func TestBackfillGapAtEnd(t *testing.T) {
+	b := newBackfill()
+	b.Set("logs", 0, 0, 10) // offset 9 is a transaction marker
+	b.Assign(map[string][]int32{"logs": {0}})
+
+	b.Skip(&sarama.ConsumerMessage{Topic: "logs", Partition: 0, Offset: 7})
+	b.Skip(&sarama.ConsumerMessage{Topic: "logs", Partition: 0, Offset: 8})
+	b.Commit("logs", 0, 7)
+
+	// end offset reached while message 8 is in-flight
+	if !b.Skip(&sarama.ConsumerMessage{Topic: "logs", Partition: 0, Offset: 10}) {
+		t.Error("Expected skip at end offset")
+	}
+	if isDone(b) {
+		t.Fatal("Unexpected done with pending ACK")
+	}
+
+	b.Commit("logs", 0, 8)
+	if !isDone(b) {
+		t.Fatal("Expected done once messages before end offset are acknowledged")
+	}
+	if n := b.Pending(); n != 0 {
+		t.Errorf("Expected no pending messages, found %d", n)
+	}
+}
+
+func TestBackfillCommit(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{"run_once": true})
+	bt.backfill = newBackfill()
+	bt.backfill.Set("watch", 0, 0, 2)
+	bt.backfill.Assign(map[string][]int32{"watch": {0}})
+	bt.offsets = newOffsetTracker(bt.backfill.Commit)
+
+	client := &testClient{}
+	bt.pipeline = client
+	runTestWorker(bt,
+		&sarama.ConsumerMessage{Topic: "watch", Offset: 0, Value: []byte(`{}`)},
+		&sarama.ConsumerMessage{Topic: "watch", Offset: 1, Value: []byte(`{}`)},
+	)
+
+	bt.ackEvents([]interface{}{client.events[0].Private})
+	if isDone(bt.backfill) {
+		t.Fatal("Unexpected done with pending ACK")
+	}
+	bt.ackEvents([]interface{}{client.events[1].Private})
+	if !isDone(bt.backfill) {
+		t.Fatal("Expected done once all events are acknowledged")
+	}
+}
+
+func TestBackfillSnapshot(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	ms := ts.UnixNano() / int64(time.Millisecond)
+
+	for _, test := range []struct {
+		until   *initialOffset
+		pending int64
+	}{
+		// partition 0 from committed 5 to 100, partition 1 from newest
+		{&initialOffset{position: sarama.OffsetNewest}, 95},
+		// partition 0 up to 42, no messages after timestamp in partition 1
+		{&initialOffset{position: sarama.OffsetNewest, timestamp: ts}, 37},
+	} {
+		offsets := sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("logs", 0, ms, 42).
+			SetOffset("logs", 1, ms, -1)
+		broker := newTestOffsetsBroker(t, offsets)
+
+		cfg := sarama.NewConfig()
+		cfg.Version = sarama.V0_10_1_0
+		client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		initial := &initialOffset{position: sarama.OffsetNewest}
+		b, err := snapshotBackfill(client, "kafkabeat", []string{"logs"}, initial, test.until)
+		client.Close()
+		broker.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := b.Pending(); n != test.pending {
+			t.Errorf("Expected %d pending messages, found %d", test.pending, n)
+		}
+	}
+}
+
+func TestBackfillConfigInvalid(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		{"until": "2024-05-01T00:00:00Z"},
+		{"run_once": true, "until": "yesterday"},
+	} {
+		cfg, err := common.NewConfigFrom(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("Error expected for %v", settings)
+		}
+	}
+}
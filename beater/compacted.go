@@ -0,0 +1,81 @@
+package beater
+
+import (
+	"errors"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Compacted topic decoder
+//
+// Every record key maps to a single document, the latest value wins:
+// document ID is derived from the key and @metadata.op_type is set to
+// "index". Tombstones (nil value) become events with op_type "delete"
+// instead of being decoded, see honoursOpType.
+type compactedDecoder struct {
+	codec           decoder
+	idTarget        string
+	idHash          bool
+	timestampHeader string
+	timestampLayout string
+	timeNowFn       func() time.Time
+}
+
+func newCompactedDecoder(codec decoder, cfg config.CodecConfig, documentID config.DocumentIDConfig) *compactedDecoder {
+	return &compactedDecoder{
+		codec:           codec,
+		idTarget:        documentID.Target,
+		idHash:          documentID.Hash,
+		timestampHeader: cfg.TimestampHeader,
+		timestampLayout: cfg.TimestampLayout,
+		timeNowFn:       time.Now,
+	}
+}
+
+func (d *compactedDecoder) Decode(msg *sarama.ConsumerMessage) ([]beat.Event, error) {
+	if msg.Key == nil {
+		return nil, newDecodeError("compacted", errors.New("message without key"))
+	}
+	id := documentID(string(msg.Key), d.idHash)
+
+	if msg.Value == nil {
+		ts := messageTimestamp(msg, d.timestampHeader, d.timestampLayout)
+		if ts.IsZero() {
+			ts = d.timeNowFn()
+		}
+		event := beat.Event{
+			Timestamp: ts,
+			Fields:    common.MapStr{},
+			Meta:      common.MapStr{"op_type": "delete"},
+		}
+		putEventValue(&event, d.idTarget, id)
+		return []beat.Event{event}, nil
+	}
+
+	events, err := d.codec.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		if events[i].Meta == nil {
+			events[i].Meta = common.MapStr{}
+		}
+		events[i].Meta["op_type"] = "index"
+		putEventValue(&events[i], d.idTarget, id)
+	}
+	return events, nil
+}
+
+// Whether output can act on @metadata.op_type. Elasticsearch output of
+// libbeat 6.4 ignores it and sends events with ID as "create" treating
+// conflicts as success, so the first value would win and tombstones would
+// be indexed as empty documents. Logstash output passes @metadata on to
+// elasticsearch output with action => "%{[@metadata][op_type]}".
+func honoursOpType(output string) bool {
+	return output == "logstash"
+}
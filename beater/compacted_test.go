@@ -0,0 +1,175 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs/elasticsearch"
+	"github.com/elastic/beats/libbeat/outputs/outest"
+	"github.com/elastic/beats/libbeat/outputs/outil"
+)
+
+func newTestCompactedBeater(t *testing.T, settings map[string]interface{}) *Kafkabeat {
+	bt, err := newTestOutputBeater(t, "logstash", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bt
+}
+
+func TestCompacted(t *testing.T) {
+	bt := newTestCompactedBeater(t, map[string]interface{}{
+		"compacted": true,
+		"document_id": map[string]interface{}{
+			"source": "coordinates", // key wins for compacted topics
+		},
+	})
+	tracker, commits := newTestOffsetTracker()
+	bt.offsets = tracker
+	client := &testClient{}
+	bt.pipeline = client
+
+	runTestWorker(bt,
+		&sarama.ConsumerMessage{Topic: "users", Offset: 1, Key: []byte("user-1"), Value: []byte(`{"name":"alice"}`)},
+		&sarama.ConsumerMessage{Topic: "users", Offset: 2, Key: []byte("user-1")},
+		&sarama.ConsumerMessage{Topic: "users", Offset: 3, Value: []byte(`{"name":"bob"}`)},
+	)
+
+	if len(client.events) != 2 {
+		t.Fatalf("Expected 2 events, found %d", len(client.events))
+	}
+	upsert, tombstone := client.events[0], client.events[1]
+	if upsert.Meta["id"] != "user-1" || upsert.Meta["op_type"] != "index" || upsert.Fields["name"] != "alice" {
+		t.Errorf("Unexpected event of value %v", upsert)
+	}
+	if tombstone.Meta["id"] != "user-1" || tombstone.Meta["op_type"] != "delete" || len(tombstone.Fields) != 0 {
+		t.Errorf("Unexpected event of tombstone %v", tombstone)
+	}
+
+	// message without key is dropped as decode error, offsets move past it
+	bt.ackEvents([]interface{}{upsert.Private, tombstone.Private})
+	if len(*commits) == 0 || (*commits)[len(*commits)-1].offset != 3 {
+		t.Errorf("Expected offsets committed up to 3, found %v", *commits)
+	}
+}
+
+func TestCompactedTopic(t *testing.T) {
+	bt := newTestCompactedBeater(t, map[string]interface{}{
+		"topics": []interface{}{
+			"watch",
+			map[string]interface{}{"topic": "users", "codec": "plain", "compacted": true},
+		},
+		"document_id": map[string]interface{}{"hash": true},
+	})
+	global, users := &testClient{}, &testClient{}
+	bt.pipeline = global
+	bt.topics.Lookup("users").pipeline = users
+
+	runTestWorker(bt,
+		&sarama.ConsumerMessage{Topic: "watch", Offset: 1, Value: []byte(`{}`)},
+		&sarama.ConsumerMessage{Topic: "users", Offset: 1, Key: []byte("user-1")},
+	)
+
+	if _, exists := global.events[0].Meta["op_type"]; exists {
+		t.Errorf("Unexpected op_type of regular topic %v", global.events[0].Meta)
+	}
+	expected := "9dfffe450852c20c8876f6e5a37da6e469bf2c9c"
+	if e := users.events[0]; e.Meta["id"] != expected || e.Meta["op_type"] != "delete" {
+		t.Errorf("Expected tombstone with hashed key id %s, found %v", expected, e.Meta)
+	}
+}
+
+func TestCompactedOutput(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		{"compacted": true},
+		{"topics": []interface{}{map[string]interface{}{"topic": "users", "compacted": true}}},
+	} {
+		for _, output := range []string{"elasticsearch", "console"} {
+			if _, err := newTestOutputBeater(t, output, settings); err == nil {
+				t.Errorf("Error expected for compacted topics with output %s", output)
+			}
+		}
+		if _, err := New(nil, common.MustNewConfigFrom(settings)); err == nil {
+			t.Error("Error expected for compacted topics without output")
+		}
+	}
+}
+
+// Bulk actions of compacted topic events sent by libbeat elasticsearch output
+func testBulkActions(t *testing.T, events ...beat.Event) []string {
+	var actions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			w.Write([]byte(`{"version":{"number":"6.4.0"}}`))
+			return
+		}
+
+		// action and source lines, tombstone source is an empty document
+		var items []string
+		dec := json.NewDecoder(r.Body)
+		for {
+			var action map[string]interface{}
+			if err := dec.Decode(&action); err != nil {
+				break
+			}
+			for name := range action {
+				actions = append(actions, name)
+				items = append(items, `{"`+name+`":{"status":201}}`)
+			}
+			var source map[string]interface{}
+			dec.Decode(&source)
+		}
+		w.Write([]byte(`{"items":[` + strings.Join(items, ",") + `]}`))
+	}))
+	defer server.Close()
+
+	client, err := elasticsearch.NewClient(elasticsearch.ClientSettings{
+		URL:   server.URL,
+		Index: outil.MakeSelector(outil.ConstSelectorExpr("kafkabeat")),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish(outest.NewBatch(events...)); err != nil {
+		t.Fatal(err)
+	}
+	return actions
+}
+
+func TestCompactedElasticsearchBulkAction(t *testing.T) {
+	d := newCompactedDecoder(newPlainDecoder("", ""), config.DefaultConfig.CodecConfig, config.DefaultConfig.DocumentID)
+
+	var events []beat.Event
+	for _, msg := range []*sarama.ConsumerMessage{
+		{Key: []byte("user-1"), Value: []byte("alice")},
+		{Key: []byte("user-1")},
+	} {
+		decoded, err := d.Decode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, decoded...)
+	}
+
+	// op_type is not honoured: value is created once and tombstone is
+	// created as document, hence compacted topics are refused with
+	// elasticsearch output
+	actions := testBulkActions(t, events...)
+	if !reflect.DeepEqual(actions, []string{"create", "create"}) || honoursOpType("elasticsearch") {
+		t.Errorf("Expected elasticsearch output to be refused, bulk actions %v", actions)
+	}
+}
@@ -0,0 +1,141 @@
+package beater
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/version"
+)
+
+// Dead-letter record headers
+const (
+	deadLetterHeaderError     = "kafkabeat.error"
+	deadLetterHeaderTopic     = "kafkabeat.source.topic"
+	deadLetterHeaderPartition = "kafkabeat.source.partition"
+	deadLetterHeaderOffset    = "kafkabeat.source.offset"
+	deadLetterHeaderVersion   = "kafkabeat.version"
+)
+
+// Dead-letter queue
+//
+// Messages failed to decode are written as is to the dead-letter sink, either
+// Kafka topic or local file. Writes are retried with backoff until they succeed
+// or beat is stopped. Retrying blocks the worker, which eventually stops
+// fetching, and the source offset is committed only once message is stored.
+type deadLetterWriter struct {
+	sink       deadLetterSink
+	done       <-chan struct{}
+	backoff    time.Duration
+	maxBackoff time.Duration
+	logger     *logp.Logger
+}
+
+type deadLetterSink interface {
+	Send(msg *sarama.ConsumerMessage, reason error) error
+	Close() error
+}
+
+func newDeadLetterWriter(
+	cfg config.DeadLetterConfig,
+	sink deadLetterSink,
+	done <-chan struct{},
+) *deadLetterWriter {
+	return &deadLetterWriter{
+		sink:       sink,
+		done:       done,
+		backoff:    cfg.Backoff,
+		maxBackoff: cfg.MaxBackoff,
+		logger:     logp.NewLogger("dead_letter"),
+	}
+}
+
+// Write stores message in the dead-letter sink, returns false if beat
+// was stopped before message was written. Called by all channel workers,
+// so every call retries with its own backoff.
+func (w *deadLetterWriter) Write(msg *sarama.ConsumerMessage, reason error) bool {
+	backoff := common.NewBackoff(w.done, w.backoff, w.maxBackoff)
+	for {
+		err := w.sink.Send(msg, reason)
+		if err == nil {
+			deadLetterMessages.Inc()
+			return true
+		}
+
+		deadLetterErrors.Inc()
+		w.logger.Errorf("failed to write topic: %s, partition: %d, offset: %d to dead-letter queue: %v",
+			msg.Topic, msg.Partition, msg.Offset, err)
+		if !backoff.Wait() {
+			return false
+		}
+	}
+}
+
+func (w *deadLetterWriter) Close() error {
+	return w.sink.Close()
+}
+
+// Dead-letter topic
+//
+// Original key, value and headers are published with additional headers
+// describing the failure.
+type deadLetterTopic struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+// Producer shares connection settings (TLS, SASL, version) with the consumer.
+// Record headers require Kafka 0.11+.
+func newDeadLetterProducer(brokers []string, kConfig sarama.Config) (sarama.SyncProducer, error) {
+	if !kConfig.Version.IsAtLeast(sarama.V0_11_0_0) {
+		return nil, fmt.Errorf("dead_letter requires kafka 0.11+, configured version: %v", kConfig.Version)
+	}
+
+	kConfig.Producer.Return.Successes = true
+	kConfig.Producer.Return.Errors = true
+	kConfig.Producer.RequiredAcks = sarama.WaitForAll
+	return sarama.NewSyncProducer(brokers, &kConfig)
+}
+
+func (t *deadLetterTopic) Send(msg *sarama.ConsumerMessage, reason error) error {
+	_, _, err := t.producer.SendMessage(t.record(msg, reason))
+	return err
+}
+
+func (t *deadLetterTopic) record(msg *sarama.ConsumerMessage, reason error) *sarama.ProducerMessage {
+	record := &sarama.ProducerMessage{
+		Topic:   t.topic,
+		Headers: make([]sarama.RecordHeader, 0, len(msg.Headers)+5),
+	}
+	if msg.Key != nil {
+		record.Key = sarama.ByteEncoder(msg.Key)
+	}
+	if msg.Value != nil {
+		record.Value = sarama.ByteEncoder(msg.Value)
+	}
+
+	for _, h := range msg.Headers {
+		record.Headers = append(record.Headers, *h)
+	}
+	record.Headers = append(record.Headers,
+		deadLetterHeader(deadLetterHeaderError, reason.Error()),
+		deadLetterHeader(deadLetterHeaderTopic, msg.Topic),
+		deadLetterHeader(deadLetterHeaderPartition, strconv.Itoa(int(msg.Partition))),
+		deadLetterHeader(deadLetterHeaderOffset, strconv.FormatInt(msg.Offset, 10)),
+		deadLetterHeader(deadLetterHeaderVersion, version.GetDefaultVersion()),
+	)
+	return record
+}
+
+func (t *deadLetterTopic) Close() error {
+	return t.producer.Close()
+}
+
+func deadLetterHeader(key, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
@@ -0,0 +1,113 @@
+package beater
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common/file"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/paths"
+	"github.com/elastic/beats/libbeat/version"
+)
+
+// Dead-letter file
+//
+// Messages are appended as NDJSON lines to the file in path.data (unless
+// absolute path is configured), rotated by size. Every line is synced to disk
+// before the source offset is committed.
+type deadLetterFile struct {
+	rotator *file.Rotator
+}
+
+// Dead-letter file line, raw key, value and header values are base64 encoded
+type deadLetterRecord struct {
+	Error     string                   `json:"error"`
+	Topic     string                   `json:"topic"`
+	Partition int32                    `json:"partition"`
+	Offset    int64                    `json:"offset"`
+	Timestamp *time.Time               `json:"timestamp,omitempty"`
+	Key       []byte                   `json:"key,omitempty"`
+	Value     []byte                   `json:"value"`
+	Headers   []deadLetterRecordHeader `json:"headers,omitempty"`
+	Version   string                   `json:"version"`
+}
+
+type deadLetterRecordHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func newDeadLetterFile(cfg config.DeadLetterFileConfig) (*deadLetterFile, error) {
+	rotator, err := file.NewFileRotator(
+		paths.Resolve(paths.Data, cfg.Path),
+		file.MaxSizeBytes(uint(cfg.MaxSize)),
+		file.MaxBackups(cfg.MaxBackups),
+		file.WithLogger(logp.NewLogger("dead_letter")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterFile{rotator: rotator}, nil
+}
+
+func (f *deadLetterFile) Send(msg *sarama.ConsumerMessage, reason error) error {
+	line, err := json.Marshal(newDeadLetterRecord(msg, reason))
+	if err != nil {
+		return err
+	}
+	if _, err := f.rotator.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.rotator.Sync()
+}
+
+func (f *deadLetterFile) Close() error {
+	return f.rotator.Close()
+}
+
+func newDeadLetterRecord(msg *sarama.ConsumerMessage, reason error) *deadLetterRecord {
+	r := &deadLetterRecord{
+		Error:     reason.Error(),
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Version:   version.GetDefaultVersion(),
+	}
+	if !msg.Timestamp.IsZero() {
+		ts := msg.Timestamp
+		r.Timestamp = &ts
+	}
+	for _, h := range msg.Headers {
+		r.Headers = append(r.Headers, deadLetterRecordHeader{
+			Key:   string(h.Key),
+			Value: h.Value,
+		})
+	}
+	return r
+}
+
+// Message restores original Kafka message
+func (r *deadLetterRecord) Message() *sarama.ConsumerMessage {
+	msg := &sarama.ConsumerMessage{
+		Topic:     r.Topic,
+		Partition: r.Partition,
+		Offset:    r.Offset,
+		Key:       r.Key,
+		Value:     r.Value,
+	}
+	if r.Timestamp != nil {
+		msg.Timestamp = *r.Timestamp
+	}
+	for _, h := range r.Headers {
+		msg.Headers = append(msg.Headers, &sarama.RecordHeader{
+			Key:   []byte(h.Key),
+			Value: h.Value,
+		})
+	}
+	return msg
+}
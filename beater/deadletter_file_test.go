@@ -0,0 +1,189 @@
+// +build !integration
+
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/cfgtype"
+)
+
+func newTestDeadLetterFile(t *testing.T, maxSize int64, maxBackups uint) (*deadLetterFile, string) {
+	dir, err := ioutil.TempDir("", "kafkabeat-dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "dlq.ndjson")
+	f, err := newDeadLetterFile(config.DeadLetterFileConfig{
+		Path:       path,
+		MaxSize:    cfgtype.ByteSize(maxSize),
+		MaxBackups: maxBackups,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return f, path
+}
+
+func TestDeadLetterFileRecord(t *testing.T) {
+	f, path := newTestDeadLetterFile(t, 1024*1024, 1)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	w := newTestDeadLetterWriter(f, make(chan struct{}))
+	msg := newTestMetadataMessage()
+	msg.Value = []byte{0xff, 0x00, '{'}
+	if !w.Write(msg, errors.New("invalid character")) {
+		t.Fatal("Message must be written")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`"error":"invalid character"`,
+		`"topic":"watch","partition":3,"offset":42`,
+		`"key":"dXNlci0x"`,
+		`"value":"/wB7"`,
+		`"headers":[{"key":"tenant","value":"YWNtZQ=="}]`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %s in %s", expected, data)
+		}
+	}
+
+	record := deadLetterRecord{}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &record); err != nil {
+		t.Fatal(err)
+	}
+	restored := record.Message()
+	restored.Timestamp = restored.Timestamp.UTC()
+	if !reflect.DeepEqual(restored, msg) {
+		t.Errorf("Expected %v", msg)
+		t.Errorf("   found %v", restored)
+	}
+}
+
+func TestDeadLetterFileRotation(t *testing.T) {
+	f, path := newTestDeadLetterFile(t, 512, 2)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	w := newTestDeadLetterWriter(f, make(chan struct{}))
+	for i := 0; i < 10; i++ {
+		if !w.Write(newTestMetadataMessage(), errors.New("invalid character")) {
+			t.Fatal("Message must be written")
+		}
+	}
+	w.Close()
+
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{path, path + ".1", path + ".2"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", files)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"codec":          "json",
+		"kafka_metadata": "fields",
+	})
+	r := &replayer{bt: bt, filename: "dlq.ndjson", logger: bt.logger}
+	client := &testClient{}
+	bt.pipeline = client
+
+	var lines bytes.Buffer
+	for _, value := range []string{`{"field":"value"}`, `{"field":`, `{"field":"other"}`} {
+		msg := &sarama.ConsumerMessage{Topic: "watch", Offset: int64(lines.Len()), Value: []byte(value)}
+		line, err := json.Marshal(newDeadLetterRecord(msg, errors.New("unexpected end of JSON input")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines.Write(append(line, '\n'))
+	}
+
+	messages, failed, err := r.replay(bufio.NewReader(&lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages != 2 || failed != 1 {
+		t.Errorf("Expected 2 replayed and 1 failed message, found %d and %d", messages, failed)
+	}
+	published := client.events
+	if len(published) != 2 {
+		t.Fatalf("Expected 2 events, found %d", len(published))
+	}
+	if topic, _ := published[1].Fields.GetValue("kafka.topic"); topic != "watch" {
+		t.Errorf("Expected kafka metadata, found %v", published[1].Fields)
+	}
+	if published[1].Fields["field"] != "other" {
+		t.Errorf("Unexpected event %v", published[1].Fields)
+	}
+
+	// invalid line
+	_, _, err = r.replay(strings.NewReader("not a record\n"))
+	if err == nil {
+		t.Error("Error expected for invalid dead-letter record")
+	}
+}
+
+func TestDeadLetterReplayDocumentID(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"document_id": map[string]interface{}{"source": "coordinates"},
+	})
+	r := &replayer{bt: bt, filename: "dlq.ndjson", logger: bt.logger}
+	client := &testClient{}
+	bt.pipeline = client
+
+	// same ID as of the original delivery
+	msg := &sarama.ConsumerMessage{Topic: "watch", Partition: 2, Offset: 42, Value: []byte(`{"field":"value"}`)}
+	line, err := json.Marshal(newDeadLetterRecord(msg, errors.New("output failure")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.replay(bytes.NewReader(line)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.events) != 1 {
+		t.Fatalf("Expected single event, found %d", len(client.events))
+	}
+	if id, _ := client.events[0].Meta.GetValue("id"); id != "watch-2-42" {
+		t.Errorf("Expected id watch-2-42 of replayed message, found %v", id)
+	}
+}
+
+func TestDeadLetterExclusiveSinks(t *testing.T) {
+	cfg, err := common.NewConfigFrom(map[string]interface{}{
+		"dead_letter.topic":     "watch-dlq",
+		"dead_letter.file.path": "dlq.ndjson",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(nil, cfg); err == nil {
+		t.Error("Error expected for both dead-letter topic and file")
+	}
+}
@@ -0,0 +1,208 @@
+// +build !integration
+
+package beater
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/version"
+)
+
+// Sync producer failing first n writes, all writes if n is negative
+type testProducer struct {
+	mu       sync.Mutex
+	failures int
+	sent     []*sarama.ProducerMessage
+}
+
+func (p *testProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failures != 0 {
+		p.failures--
+		return 0, 0, sarama.ErrNotEnoughReplicas
+	}
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent) - 1), nil
+}
+
+func (p *testProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *testProducer) Close() error {
+	return nil
+}
+
+func newTestDeadLetterWriter(sink deadLetterSink, done <-chan struct{}) *deadLetterWriter {
+	cfg := config.DeadLetterConfig{
+		Backoff:    time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+	return newDeadLetterWriter(cfg, sink, done)
+}
+
+func newTestDeadLetterTopic(producer *testProducer, done <-chan struct{}) *deadLetterWriter {
+	return newTestDeadLetterWriter(&deadLetterTopic{topic: "watch-dlq", producer: producer}, done)
+}
+
+func TestDeadLetterWrite(t *testing.T) {
+	producer := &testProducer{}
+	w := newTestDeadLetterTopic(producer, make(chan struct{}))
+
+	msg := newTestMetadataMessage()
+	if !w.Write(msg, errors.New("invalid character")) {
+		t.Fatal("Message must be written")
+	}
+	if len(producer.sent) != 1 {
+		t.Fatalf("Expected single record, found %d", len(producer.sent))
+	}
+
+	record := producer.sent[0]
+	if record.Topic != "watch-dlq" {
+		t.Errorf("Unexpected topic %s", record.Topic)
+	}
+	if key, _ := record.Key.Encode(); string(key) != "user-1" {
+		t.Errorf("Unexpected key %s", key)
+	}
+	if value, _ := record.Value.Encode(); string(value) != string(msg.Value) {
+		t.Errorf("Unexpected value %s", value)
+	}
+
+	expected := []sarama.RecordHeader{
+		{Key: []byte("tenant"), Value: []byte("acme")},
+		{Key: []byte("kafkabeat.error"), Value: []byte("invalid character")},
+		{Key: []byte("kafkabeat.source.topic"), Value: []byte("watch")},
+		{Key: []byte("kafkabeat.source.partition"), Value: []byte("3")},
+		{Key: []byte("kafkabeat.source.offset"), Value: []byte("42")},
+		{Key: []byte("kafkabeat.version"), Value: []byte(version.GetDefaultVersion())},
+	}
+	if !reflect.DeepEqual(record.Headers, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", record.Headers)
+	}
+}
+
+func TestDeadLetterWriteNilKey(t *testing.T) {
+	producer := &testProducer{}
+	w := newTestDeadLetterTopic(producer, make(chan struct{}))
+
+	if !w.Write(&sarama.ConsumerMessage{Topic: "watch"}, errors.New("empty")) {
+		t.Fatal("Message must be written")
+	}
+	if producer.sent[0].Key != nil || producer.sent[0].Value != nil {
+		t.Error("Nil key and value must be preserved")
+	}
+}
+
+func TestDeadLetterRetry(t *testing.T) {
+	producer := &testProducer{failures: 3}
+	w := newTestDeadLetterTopic(producer, make(chan struct{}))
+
+	if !w.Write(newTestMetadataMessage(), errors.New("invalid character")) {
+		t.Fatal("Message must be written")
+	}
+	if len(producer.sent) != 1 || producer.failures != 0 {
+		t.Errorf("Expected write after 3 retries, found %d records", len(producer.sent))
+	}
+}
+
+func TestDeadLetterStopWhileRetrying(t *testing.T) {
+	done := make(chan struct{})
+	producer := &testProducer{failures: -1}
+	w := newTestDeadLetterTopic(producer, done)
+
+	time.AfterFunc(20*time.Millisecond, func() { close(done) })
+	if w.Write(newTestMetadataMessage(), errors.New("invalid character")) {
+		t.Error("Write must fail once beat is stopped")
+	}
+}
+
+// Channel workers share the writer, run with -race
+func TestDeadLetterConcurrentWrite(t *testing.T) {
+	producer := &testProducer{failures: 8}
+	w := newTestDeadLetterTopic(producer, make(chan struct{}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(partition int32) {
+			defer wg.Done()
+			for offset := int64(0); offset < 4; offset++ {
+				msg := &sarama.ConsumerMessage{Topic: "watch", Partition: partition, Offset: offset}
+				if !w.Write(msg, errors.New("invalid character")) {
+					t.Error("Message must be written")
+				}
+			}
+		}(int32(i))
+	}
+	wg.Wait()
+
+	if len(producer.sent) != 16 {
+		t.Errorf("Expected 16 records, found %d", len(producer.sent))
+	}
+}
+
+func TestDeadLetterOffsetCommit(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"dead_letter.topic": "watch-dlq",
+	})
+	tracker, commits := newTestOffsetTracker()
+	bt.offsets = tracker
+
+	producer := &testProducer{failures: -1}
+	bt.deadLetter = newTestDeadLetterTopic(producer, bt.done)
+
+	messages := make(chan *trackedMessage, 1)
+	messages <- tracker.Track(&sarama.ConsumerMessage{Topic: "watch", Offset: 1, Value: []byte("{")})
+	close(messages)
+
+	// failing write blocks the worker, offset stays uncommitted
+	bt.workers.Add(1)
+	go bt.workerFn(messages)
+	time.Sleep(20 * time.Millisecond)
+	close(bt.done)
+	bt.workers.Wait()
+
+	if len(*commits) != 0 {
+		t.Errorf("Offset must not be committed on failed write, found %v", *commits)
+	}
+
+	// successful write commits the offset
+	bt.done = make(chan struct{})
+	bt.deadLetter = newTestDeadLetterTopic(&testProducer{}, bt.done)
+
+	messages = make(chan *trackedMessage, 1)
+	messages <- tracker.Track(&sarama.ConsumerMessage{Topic: "watch", Partition: 1, Offset: 2, Value: []byte("{")})
+	close(messages)
+
+	bt.workers.Add(1)
+	bt.workerFn(messages)
+
+	expected := []testCommit{{"watch", 1, 2}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestDeadLetterRequiresHeaders(t *testing.T) {
+	kConfig := sarama.NewConfig()
+	kConfig.Version = sarama.V0_10_2_0
+	if _, err := newDeadLetterProducer([]string{"localhost:9092"}, *kConfig); err == nil {
+		t.Error("Error expected for kafka version without record headers")
+	}
+}
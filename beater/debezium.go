@@ -0,0 +1,168 @@
+package beater
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Debezium change event envelope, payload of schema/payload form. Row images
+// are decoded as by JSON codec, keeping bigint columns exact.
+type debeziumEnvelope struct {
+	Before json.RawMessage        `json:"before"`
+	After  json.RawMessage        `json:"after"`
+	Source map[string]interface{} `json:"source"`
+	Op     string                 `json:"op"`
+	TsMs   *int64                 `json:"ts_ms"`
+	Inner  *debeziumEnvelope      `json:"payload"`
+}
+
+// Debezium change data capture decoder
+//
+// Unwraps {before, after, source, op, ts_ms} envelope, JSON with or without
+// schema. After image (before image of deletes) becomes the event, op and
+// source database and table are put into @metadata.debezium, ts_ms becomes
+// @timestamp. Tombstones following deletes are skipped. With debezium.deletes
+// document ID is derived from the primary key (message key) and
+// @metadata.op_type is set to "index", or "delete" for deletes.
+type debeziumDecoder struct {
+	deletes         bool
+	idTarget        string
+	idHash          bool
+	timestampHeader string
+	timestampLayout string
+	timeNowFn       func() time.Time
+}
+
+func newDebeziumDecoder(cfg config.CodecConfig, documentID config.DocumentIDConfig) *debeziumDecoder {
+	return &debeziumDecoder{
+		deletes:         cfg.Debezium.Deletes,
+		idTarget:        documentID.Target,
+		idHash:          documentID.Hash,
+		timestampHeader: cfg.TimestampHeader,
+		timestampLayout: cfg.TimestampLayout,
+		timeNowFn:       time.Now,
+	}
+}
+
+func (d *debeziumDecoder) Decode(msg *sarama.ConsumerMessage) ([]beat.Event, error) {
+	if msg.Value == nil {
+		return nil, nil // tombstone for log compaction
+	}
+
+	var envelope debeziumEnvelope
+	if err := json.Unmarshal(msg.Value, &envelope); err != nil {
+		return nil, newDecodeError("debezium", err)
+	}
+	if envelope.Inner != nil {
+		envelope = *envelope.Inner // schema/payload form
+	}
+	if envelope.Op == "" {
+		return nil, newDecodeError("debezium", errors.New("missing op, not a change event envelope"))
+	}
+
+	image := envelope.After
+	if envelope.Op == "d" {
+		image = envelope.Before
+	}
+	if len(image) == 0 || string(image) == "null" {
+		return nil, nil // e.g. truncate
+	}
+	fields, err := unmarshalJSONObject(image)
+	if err != nil {
+		return nil, newDecodeError("debezium", err)
+	}
+
+	meta := common.MapStr{"op": envelope.Op}
+	if db, ok := envelope.Source["db"]; ok {
+		meta["database"] = db
+	}
+	if schema, ok := envelope.Source["schema"]; ok {
+		meta["schema"] = schema
+	}
+	if table, ok := envelope.Source["table"]; ok {
+		meta["table"] = table
+	} else if collection, ok := envelope.Source["collection"]; ok {
+		meta["table"] = collection
+	}
+
+	var ts time.Time
+	if envelope.TsMs != nil {
+		ts = time.Unix(0, *envelope.TsMs*int64(time.Millisecond)).UTC()
+	}
+	if ts.IsZero() {
+		ts = messageTimestamp(msg, d.timestampHeader, d.timestampLayout)
+	}
+	if ts.IsZero() {
+		ts = d.timeNowFn()
+	}
+
+	event := beat.Event{
+		Timestamp: ts,
+		Fields:    common.MapStr(fields),
+		Meta:      common.MapStr{"debezium": meta},
+	}
+
+	if d.deletes {
+		id, err := debeziumKey(msg.Key)
+		if err != nil {
+			return nil, newDecodeError("debezium", err)
+		}
+		event.Meta["op_type"] = "index"
+		if envelope.Op == "d" {
+			event.Meta["op_type"] = "delete"
+		}
+		putEventValue(&event, d.idTarget, documentID(id, d.idHash))
+	}
+	return []beat.Event{event}, nil
+}
+
+// Primary key of message key: value of single key field, JSON object of key
+// fields (sorted by name) for composite keys. Key which is not JSON object
+// is used as is.
+func debeziumKey(key []byte) (string, error) {
+	if key == nil {
+		return "", errors.New("message without key")
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(key))
+	dec.UseNumber() // no precision loss of bigint keys
+	if err := dec.Decode(&v); err != nil {
+		return string(key), nil
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Sprint(v), nil
+	}
+	if payload, ok := m["payload"].(map[string]interface{}); ok {
+		if _, ok := m["schema"]; ok {
+			m = payload
+		}
+	}
+	if len(m) == 0 {
+		return "", errors.New("empty key")
+	}
+
+	if len(m) == 1 {
+		for _, v := range m {
+			return fmt.Sprint(v), nil
+		}
+	}
+
+	// values may contain any separator, encoding/json sorts keys
+	id, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
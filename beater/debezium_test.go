@@ -0,0 +1,180 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const testDebeziumSource = `{"connector":"mysql","db":"inventory","table":"customers","ts_ms":1714521600000}`
+
+func newTestDebeziumDecoder(deletes bool) *debeziumDecoder {
+	cfg := config.DefaultConfig.CodecConfig
+	cfg.Debezium.Deletes = deletes
+	return newDebeziumDecoder(cfg, config.DefaultConfig.DocumentID)
+}
+
+func TestDebeziumDecoder(t *testing.T) {
+	d := newTestDebeziumDecoder(false)
+
+	for name, value := range map[string]string{
+		"json": `{"before":null,"after":{"id":1001,"email":"sally@example.com","account":9007199254740993},` +
+			`"source":` + testDebeziumSource + `,"op":"c","ts_ms":1714521600123}`,
+		"schema": `{"schema":{"type":"struct","name":"inventory.customers.Envelope"},"payload":` +
+			`{"before":null,"after":{"id":1001,"email":"sally@example.com","account":9007199254740993},` +
+			`"source":` + testDebeziumSource + `,"op":"c","ts_ms":1714521600123}}`,
+	} {
+		events, err := d.Decode(&sarama.ConsumerMessage{Value: []byte(value)})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(events) != 1 {
+			t.Fatalf("%s: expected single event, found %d", name, len(events))
+		}
+
+		e := events[0]
+		if e.Fields["email"] != "sally@example.com" || e.Fields["id"] != int64(1001) {
+			t.Errorf("%s: expected after image, found %v", name, e.Fields)
+		}
+		if account := e.Fields["account"]; account != int64(9007199254740993) {
+			t.Errorf("%s: expected exact bigint column, found %v", name, account)
+		}
+		expected := common.MapStr{"op": "c", "database": "inventory", "table": "customers"}
+		if m, _ := e.Meta.GetValue("debezium"); m.(common.MapStr).String() != expected.String() {
+			t.Errorf("%s: expected metadata %v, found %v", name, expected, m)
+		}
+		if ts := time.Date(2024, 5, 1, 0, 0, 0, 123000000, time.UTC); !e.Timestamp.Equal(ts) {
+			t.Errorf("%s: expected timestamp %v, found %v", name, ts, e.Timestamp)
+		}
+		if _, exists := e.Meta["op_type"]; exists {
+			t.Errorf("%s: unexpected op_type without debezium.deletes", name)
+		}
+	}
+}
+
+func TestDebeziumDecoderDelete(t *testing.T) {
+	value := []byte(`{"before":{"id":1001,"email":"sally@example.com"},"after":null,` +
+		`"source":` + testDebeziumSource + `,"op":"d","ts_ms":1714521600123}`)
+
+	// before image published as regular event
+	events, err := newTestDebeziumDecoder(false).Decode(&sarama.ConsumerMessage{Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op, _ := events[0].Meta.GetValue("debezium.op"); op != "d" || events[0].Fields["email"] != "sally@example.com" {
+		t.Errorf("Expected before image of delete, found %v", events[0])
+	}
+
+	// document deletion keyed by primary key
+	d := newTestDebeziumDecoder(true)
+	for key, id := range map[string]string{
+		`{"id":1001}`: "1001",
+		`{"schema":{"type":"struct"},"payload":{"order_id":18446744073709551615,"line":2}}`: `{"line":2,"order_id":18446744073709551615}`,
+		`{"a":"1-2","b":"3"}`: `{"a":"1-2","b":"3"}`,
+		`{"a":"1","b":"2-3"}`: `{"a":"1","b":"2-3"}`,
+		`sally`: "sally",
+	} {
+		events, err := d.Decode(&sarama.ConsumerMessage{Key: []byte(key), Value: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := events[0]; e.Meta["op_type"] != "delete" || e.Meta["id"] != id {
+			t.Errorf("Expected delete of document %s, found %v", id, e.Meta)
+		}
+	}
+
+	// changes are indexed by primary key
+	insert := []byte(`{"after":{"id":1001},"op":"u","ts_ms":1714521600123}`)
+	events, err = d.Decode(&sarama.ConsumerMessage{Key: []byte(`{"id":1001}`), Value: insert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := events[0]; e.Meta["op_type"] != "index" || e.Meta["id"] != "1001" {
+		t.Errorf("Expected index of document 1001, found %v", e.Meta)
+	}
+
+	if _, err := d.Decode(&sarama.ConsumerMessage{Value: value}); err == nil {
+		t.Error("Error expected for delete without key")
+	}
+}
+
+func TestDebeziumDecoderSkipped(t *testing.T) {
+	d := newTestDebeziumDecoder(true)
+	for name, value := range map[string][]byte{
+		"tombstone": nil,
+		"truncate":  []byte(`{"before":null,"after":null,"op":"t","ts_ms":1714521600123}`),
+	} {
+		events, err := d.Decode(&sarama.ConsumerMessage{Key: []byte(`{"id":1}`), Value: value})
+		if err != nil || len(events) != 0 {
+			t.Errorf("%s: expected no events, found %v, %v", name, events, err)
+		}
+	}
+}
+
+func TestDebeziumDecoderInvalid(t *testing.T) {
+	d := newTestDebeziumDecoder(false)
+	for _, value := range []string{`{"after":`, `{"id":1001}`, `[]`} {
+		_, err := d.Decode(&sarama.ConsumerMessage{Value: []byte(value)})
+		if _, ok := err.(*decodeError); !ok {
+			t.Errorf("Expected decode error for %s, found %v", value, err)
+		}
+	}
+}
+
+func TestDebeziumCodecConfig(t *testing.T) {
+	settings := map[string]interface{}{
+		"codec":    "debezium",
+		"debezium": map[string]interface{}{"deletes": true},
+	}
+	bt, err := newTestOutputBeater(t, "logstash", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := bt.codec.(*debeziumDecoder); !ok || !d.deletes || d.idTarget != "@metadata.id" {
+		t.Errorf("Expected debezium decoder with deletes, found %v", bt.codec)
+	}
+
+	// elasticsearch output of libbeat 6.4 would create deletes as documents
+	if _, err := newTestOutputBeater(t, "elasticsearch", settings); err == nil {
+		t.Error("Error expected for debezium.deletes with elasticsearch output")
+	}
+}
+
+func TestDebeziumCompacted(t *testing.T) {
+	if _, err := newTestOutputBeater(t, "logstash", map[string]interface{}{
+		"codec":     "debezium",
+		"compacted": true,
+		"debezium":  map[string]interface{}{"deletes": true},
+	}); err == nil {
+		t.Error("Error expected for debezium.deletes of compacted topic")
+	}
+
+	// without deletes, delete is indexed as before image until tombstone
+	bt := newTestCompactedBeater(t, map[string]interface{}{
+		"codec":     "debezium",
+		"compacted": true,
+	})
+	client := &testClient{}
+	bt.pipeline = client
+
+	key := []byte(`{"id":1001}`)
+	runTestWorker(bt,
+		&sarama.ConsumerMessage{Topic: "customers", Offset: 1, Key: key, Value: []byte(
+			`{"before":{"id":1001},"after":null,"source":` + testDebeziumSource + `,"op":"d"}`)},
+		&sarama.ConsumerMessage{Topic: "customers", Offset: 2, Key: key},
+	)
+	if len(client.events) != 2 {
+		t.Fatalf("Expected 2 events, found %d", len(client.events))
+	}
+	for i, opType := range []string{"index", "delete"} {
+		if e := client.events[i]; e.Meta["op_type"] != opType || e.Meta["id"] != string(key) {
+			t.Errorf("Expected %s of document %s, found %v", opType, key, e.Meta)
+		}
+	}
+}
@@ -1,37 +1,165 @@
 package beater
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
 	"time"
 
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
 	"github.com/Shopify/sarama"
 	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/paths"
 )
 
 // Decoder decoder interface
+//
+// Single message can be decoded into any number of events, message
+// decoded into no events is considered processed.
 type decoder interface {
-	Decode(msg *sarama.ConsumerMessage) *beat.Event
+	Decode(msg *sarama.ConsumerMessage) ([]beat.Event, error)
+}
+
+// Creates decoders for global and topic specific codec settings, schema
+// registry client is shared by avro decoders
+type codecFactory struct {
+	registryConfig config.SchemaRegistryConfig
+	registry       *schemaRegistry
+	documentID     config.DocumentIDConfig // of compacted topics and debezium deletes
+	output         string                  // name of beat output
+	done           <-chan struct{}
+}
+
+func newCodecFactory(
+	registryConfig config.SchemaRegistryConfig,
+	documentID config.DocumentIDConfig,
+	output string,
+	done <-chan struct{},
+) *codecFactory {
+	return &codecFactory{registryConfig: registryConfig, documentID: documentID, output: output, done: done}
+}
+
+func (f *codecFactory) Create(cfg config.CodecConfig) (decoder, error) {
+	if cfg.Compacted && !honoursOpType(f.output) {
+		return nil, fmt.Errorf("error in configuration, compacted requires logstash output, "+
+			"output '%s' does not honour @metadata.op_type", f.output)
+	}
+	if cfg.Codec == "debezium" && cfg.Debezium.Deletes {
+		if !honoursOpType(f.output) {
+			return nil, fmt.Errorf("error in configuration, debezium.deletes requires logstash output, "+
+				"output '%s' does not honour @metadata.op_type", f.output)
+		}
+		// compacted would override op_type and primary key ID of deletes
+		if cfg.Compacted {
+			return nil, fmt.Errorf("error in configuration, debezium.deletes and compacted are mutually exclusive")
+		}
+	}
+
+	d, err := f.create(cfg)
+	if err != nil || !cfg.Compacted {
+		return d, err
+	}
+	return newCompactedDecoder(d, cfg, f.documentID), nil
+}
+
+func (f *codecFactory) create(cfg config.CodecConfig) (decoder, error) {
+	switch cfg.Codec {
+	case "json":
+		return newJSONDecoder(cfg.TimestampKey, cfg.TimestampHeader, cfg.TimestampLayout), nil
+	case "plain":
+		return newPlainDecoder(cfg.TimestampHeader, cfg.TimestampLayout), nil
+	case "avro":
+		if f.registry == nil {
+			registry, err := newSchemaRegistry(f.registryConfig, f.done)
+			if err != nil {
+				return nil, err
+			}
+			f.registry = registry
+		}
+		return newAvroDecoder(f.registry, cfg.TimestampKey, cfg.TimestampHeader, cfg.TimestampLayout), nil
+	case "debezium":
+		return newDebeziumDecoder(cfg, f.documentID), nil
+	case "protobuf":
+		d, err := newProtobufDecoder(cfg.Protobuf, cfg.TimestampKey, cfg.TimestampHeader, cfg.TimestampLayout)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("error in configuration, unknown codec: '%s'", cfg.Codec)
+	}
+}
+
+// Decode error, reported by codecs for malformed messages. Other errors
+// mean message could not be processed, e.g. beat is stopping.
+type decodeError struct {
+	codec string
+	err   error
+}
+
+func newDecodeError(codec string, err error) *decodeError {
+	return &decodeError{codec: codec, err: err}
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("%s decode error: %v", e.codec, e.err)
+}
+
+// Event for message failed to decode, raw value is kept as message
+func newDecodeErrorEvent(msg *sarama.ConsumerMessage, err error, tag string) beat.Event {
+	errType := "decode_error"
+	if e, ok := err.(*decodeError); ok {
+		errType = e.codec + "_decode_error"
+		err = e.err
+	}
+
+	fields := common.MapStr{
+		"message": string(msg.Value),
+		"error": common.MapStr{
+			"message": err.Error(),
+			"type":    errType,
+		},
+	}
+	if tag != "" {
+		fields["tags"] = []string{tag}
+	}
+
+	ts := msg.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return beat.Event{
+		Timestamp: ts,
+		Fields:    fields,
+	}
 }
 
 type jsonDecoder struct {
 	timestampKey    string
+	timestampHeader string
 	timestampLayout string
 	timeNowFn       func() time.Time
 }
 
 // JSON decoder
-func newJSONDecoder(timestampKey, timestampLayout string) *jsonDecoder {
+func newJSONDecoder(timestampKey, timestampHeader, timestampLayout string) *jsonDecoder {
 	return &jsonDecoder{
 		timestampKey:    timestampKey,
+		timestampHeader: timestampHeader,
 		timestampLayout: timestampLayout,
 		timeNowFn:       time.Now,
 	}
 }
 
-func (d *jsonDecoder) Decode(msg *sarama.ConsumerMessage) *beat.Event {
-	fields := map[string]interface{}{}
-	if err := json.Unmarshal(msg.Value, &fields); err != nil {
-		return nil
+func (d *jsonDecoder) Decode(msg *sarama.ConsumerMessage) ([]beat.Event, error) {
+	fields, err := unmarshalJSONObject(msg.Value)
+	if err != nil {
+		return nil, newDecodeError("json", err)
 	}
 
 	// special @timestamp field handling
@@ -47,42 +175,262 @@ func (d *jsonDecoder) Decode(msg *sarama.ConsumerMessage) *beat.Event {
 	}
 
 	if ts.IsZero() {
-		if msg.Timestamp.IsZero() {
-			ts = d.timeNowFn()
-		} else {
-			ts = msg.Timestamp
+		ts = messageTimestamp(msg, d.timestampHeader, d.timestampLayout)
+	}
+	if ts.IsZero() {
+		ts = d.timeNowFn()
+	}
+
+	return []beat.Event{{
+		Timestamp: ts,
+		Fields:    fields,
+	}}, nil
+}
+
+// Unmarshals JSON object, integers are kept as int64 (uint64 beyond int64
+// range) instead of float64 losing precision above 2^53
+func unmarshalJSONObject(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	fields := map[string]interface{}{}
+	if err := dec.Decode(&fields); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errors.New("unexpected end of JSON input") // as of json.Unmarshal
 		}
+		return nil, err
 	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level value")
+	}
+	jsonNumbers(fields)
+	return fields, nil
+}
+
+// Replaces json.Number values of decoded JSON in place
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = jsonNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonNumbers(value)
+		}
+	}
+	return v
+}
 
-	return &beat.Event{
+// Avro decoder, Confluent wire format with schemas from Schema Registry
+type avroDecoder struct {
+	registry        *schemaRegistry
+	timestampKey    string
+	timestampHeader string
+	timestampLayout string
+	timeNowFn       func() time.Time
+}
+
+func newAvroDecoder(registry *schemaRegistry, timestampKey, timestampHeader, timestampLayout string) *avroDecoder {
+	return &avroDecoder{
+		registry:        registry,
+		timestampKey:    timestampKey,
+		timestampHeader: timestampHeader,
+		timestampLayout: timestampLayout,
+		timeNowFn:       time.Now,
+	}
+}
+
+func (d *avroDecoder) Decode(msg *sarama.ConsumerMessage) ([]beat.Event, error) {
+	id, payload, err := confluentSchemaID(msg.Value)
+	if err != nil {
+		return nil, newDecodeError("avro", err)
+	}
+
+	schema, err := d.registry.Schema(id)
+	if err != nil {
+		if _, ok := err.(*schemaError); ok {
+			return nil, newDecodeError("avro", err)
+		}
+		return nil, err // registry unavailable
+	}
+
+	value, err := schema.Decode(payload)
+	if err != nil {
+		return nil, newDecodeError("avro", err)
+	}
+	fields, ok := value.(common.MapStr)
+	if !ok {
+		return nil, newDecodeError("avro", fmt.Errorf("schema id %d is not a record", id))
+	}
+
+	// timestamp-millis or timestamp-micros field becomes @timestamp
+	var ts time.Time
+	if val, ok := fields[d.timestampKey].(common.Time); ok {
+		delete(fields, d.timestampKey)
+		ts = time.Time(val)
+	}
+	if ts.IsZero() {
+		ts = messageTimestamp(msg, d.timestampHeader, d.timestampLayout)
+	}
+	if ts.IsZero() {
+		ts = d.timeNowFn()
+	}
+
+	return []beat.Event{{
 		Timestamp: ts,
 		Fields:    fields,
+	}}, nil
+}
+
+// Protobuf decoder, message type from compiled descriptor set
+type protobufDecoder struct {
+	schema          *protobufSchema
+	message         *protobufMessage
+	confluent       bool
+	timestampKey    string
+	timestampField  string // first google.protobuf.Timestamp field if empty
+	timestampHeader string
+	timestampLayout string
+	timeNowFn       func() time.Time
+}
+
+func newProtobufDecoder(cfg config.ProtobufConfig, timestampKey, timestampHeader, timestampLayout string) (*protobufDecoder, error) {
+	if cfg.DescriptorSet == "" || cfg.MessageType == "" {
+		return nil, errors.New("error in configuration, protobuf.descriptor_set and protobuf.message_type are required")
 	}
+
+	schema, err := loadProtobufSchema(paths.Resolve(paths.Config, cfg.DescriptorSet), cfg.Int64AsString)
+	if err != nil {
+		return nil, fmt.Errorf("error in configuration, %v", err)
+	}
+	message, err := schema.Message(cfg.MessageType)
+	if err != nil {
+		return nil, fmt.Errorf("error in configuration, %v", err)
+	}
+	if cfg.TimestampField != "" && !message.HasTimestamp(cfg.TimestampField) {
+		return nil, fmt.Errorf("error in configuration, protobuf.timestamp_field '%s' is not a "+
+			"google.protobuf.Timestamp field of %s", cfg.TimestampField, cfg.MessageType)
+	}
+
+	return &protobufDecoder{
+		schema:          schema,
+		message:         message,
+		confluent:       cfg.ConfluentWireFormat,
+		timestampKey:    timestampKey,
+		timestampField:  cfg.TimestampField,
+		timestampHeader: timestampHeader,
+		timestampLayout: timestampLayout,
+		timeNowFn:       time.Now,
+	}, nil
+}
+
+func (d *protobufDecoder) Decode(msg *sarama.ConsumerMessage) ([]beat.Event, error) {
+	message, payload := d.message, msg.Value
+	if d.confluent {
+		// schema ID is not resolved, message indexes select message type
+		// within the file defining configured message type
+		_, value, err := confluentSchemaID(msg.Value)
+		if err != nil {
+			return nil, newDecodeError("protobuf", err)
+		}
+		indexes, value, err := confluentMessageIndexes(value)
+		if err != nil {
+			return nil, newDecodeError("protobuf", err)
+		}
+		if message, err = d.schema.MessageByIndexes(d.message, indexes); err != nil {
+			return nil, newDecodeError("protobuf", err)
+		}
+		payload = value
+	}
+
+	fields, err := d.schema.Decode(message, payload)
+	if err != nil {
+		return nil, newDecodeError("protobuf", err)
+	}
+
+	// google.protobuf.Timestamp field at timestamp_key becomes @timestamp,
+	// otherwise one named by protobuf.timestamp_field or the first one of
+	// the message type is used and kept in fields
+	var ts time.Time
+	if val, ok := fields[d.timestampKey].(common.Time); ok {
+		delete(fields, d.timestampKey)
+		ts = time.Time(val)
+	}
+	if ts.IsZero() {
+		name := d.timestampField
+		if name == "" {
+			name = message.timestamp
+		}
+		if val, ok := fields[name].(common.Time); ok {
+			ts = time.Time(val)
+		}
+	}
+	if ts.IsZero() {
+		ts = messageTimestamp(msg, d.timestampHeader, d.timestampLayout)
+	}
+	if ts.IsZero() {
+		ts = d.timeNowFn()
+	}
+
+	return []beat.Event{{
+		Timestamp: ts,
+		Fields:    fields,
+	}}, nil
 }
 
 // Plain decoder
 type plainDecoder struct {
-	timeNowFn func() time.Time
+	timestampHeader string
+	timestampLayout string
+	timeNowFn       func() time.Time
 }
 
-func newPlainDecoder() *plainDecoder {
+func newPlainDecoder(timestampHeader, timestampLayout string) *plainDecoder {
 	return &plainDecoder{
-		timeNowFn: time.Now,
+		timestampHeader: timestampHeader,
+		timestampLayout: timestampLayout,
+		timeNowFn:       time.Now,
 	}
 }
 
-func (d *plainDecoder) Decode(msg *sarama.ConsumerMessage) *beat.Event {
+func (d *plainDecoder) Decode(msg *sarama.ConsumerMessage) ([]beat.Event, error) {
 	fields := map[string]interface{}{
 		"message": string(msg.Value),
 	}
 
-	ts := msg.Timestamp
+	ts := messageTimestamp(msg, d.timestampHeader, d.timestampLayout)
 	if ts.IsZero() {
 		ts = d.timeNowFn()
 	}
 
-	return &beat.Event{
+	return []beat.Event{{
 		Timestamp: ts,
 		Fields:    fields,
+	}}, nil
+}
+
+// Message timestamp, either from configured header (epoch milliseconds or
+// timestamp layout) or as provided by Kafka (requires Kafka 0.10+).
+func messageTimestamp(msg *sarama.ConsumerMessage, header, layout string) time.Time {
+	if header != "" {
+		if value, found := headerValue(msg.Headers, header); found {
+			if ms, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+			}
+			if ts, err := time.Parse(layout, string(value)); err == nil {
+				return ts
+			}
+		}
 	}
+	return msg.Timestamp
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/common"
 )
 
@@ -32,17 +33,24 @@ func newTestPlainDecoder() decoder {
 	}
 }
 
+func decodeSingleEvent(t *testing.T, d decoder, msg *sarama.ConsumerMessage) *beat.Event {
+	events, err := d.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Single event must be generated, found %d", len(events))
+	}
+	return &events[0]
+}
+
 func TestJSONDecoderWithoutTimestamp(t *testing.T) {
 	d := newTestJSONDecoder()
 
 	msg := &sarama.ConsumerMessage{
 		Value: []byte(`{ "field": "value" }`),
 	}
-	e := d.Decode(msg)
-
-	if e == nil {
-		t.Fatal("Event must be generated")
-	}
+	e := decodeSingleEvent(t, d, msg)
 	if e.Fields["field"] != "value" {
 		t.Error("Expected field=value keypair, but not found on event")
 	}
@@ -59,11 +67,7 @@ func TestJSONDecoderWithMessageTimestamp(t *testing.T) {
 		Value:     []byte(`{ "field": "value" }`),
 		Timestamp: ts,
 	}
-	e := d.Decode(msg)
-
-	if e == nil {
-		t.Fatal("Event must be generated")
-	}
+	e := decodeSingleEvent(t, d, msg)
 	if e.Fields["field"] != "value" {
 		t.Error("Expected field=value keypair, but not found on event")
 	}
@@ -79,11 +83,7 @@ func TestJSONDecoderWithValidJSONTimestamp(t *testing.T) {
 	msg := &sarama.ConsumerMessage{
 		Value: []byte(`{ "@timestamp": "2019-04-26T17:16:10.945Z", "field": "value" }`),
 	}
-	e := d.Decode(msg)
-
-	if e == nil {
-		t.Fatal("Event must be generated")
-	}
+	e := decodeSingleEvent(t, d, msg)
 	if e.Fields["field"] != "value" {
 		t.Error("Expected field=value keypair, but not found on event")
 	}
@@ -98,11 +98,7 @@ func TestJSONDecoderWithInvalidJSONTimestamp(t *testing.T) {
 	msg := &sarama.ConsumerMessage{
 		Value: []byte(`{ "@timestamp": "2019-04-26T17:16:10.945759Z", "field": "value" }`),
 	}
-	e := d.Decode(msg)
-
-	if e == nil {
-		t.Fatal("Event must be generated")
-	}
+	e := decodeSingleEvent(t, d, msg)
 	if e.Fields["field"] != "value" {
 		t.Error("Expected field=value keypair, but not found on event")
 	}
@@ -112,16 +108,25 @@ func TestJSONDecoderWithInvalidJSONTimestamp(t *testing.T) {
 	}
 }
 
+func TestJSONDecoderWithInvalidJSON(t *testing.T) {
+	d := newTestJSONDecoder()
+	for _, value := range []string{`{ "field": `, `[1, 2]`, `plain text`} {
+		events, err := d.Decode(&sarama.ConsumerMessage{Value: []byte(value)})
+		if len(events) != 0 {
+			t.Errorf("No events expected for %s, found %v", value, events)
+		}
+		if _, ok := err.(*decodeError); !ok {
+			t.Errorf("Decode error expected for %s, found %v", value, err)
+		}
+	}
+}
+
 func TestPlainDecoderWithoutTimestamp(t *testing.T) {
 	d := newTestPlainDecoder()
 	msg := &sarama.ConsumerMessage{
 		Value: []byte(`mymessage`),
 	}
-	e := d.Decode(msg)
-
-	if e == nil {
-		t.Fatal("Event must be generated")
-	}
+	e := decodeSingleEvent(t, d, msg)
 	if e.Fields["message"] != "mymessage" {
 		t.Error("Expected message=mymessage keypair, but not found on event")
 	}
@@ -138,11 +143,7 @@ func TestPlainDecoderWithMessageTimestamp(t *testing.T) {
 		Value:     []byte(`mymessage`),
 		Timestamp: ts,
 	}
-	e := d.Decode(msg)
-
-	if e == nil {
-		t.Fatal("Event must be generated")
-	}
+	e := decodeSingleEvent(t, d, msg)
 	if e.Fields["message"] != "mymessage" {
 		t.Error("Expected message=mymessage keypair, but not found on event")
 	}
@@ -151,3 +152,45 @@ func TestPlainDecoderWithMessageTimestamp(t *testing.T) {
 		t.Errorf("   found %v", e.Timestamp)
 	}
 }
+
+func TestDecoderWithHeaderTimestamp(t *testing.T) {
+	ts := time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC)
+	decoders := map[string]decoder{
+		"json":  newJSONDecoder("@timestamp", "ts", common.TsLayout),
+		"plain": newPlainDecoder("ts", common.TsLayout),
+	}
+
+	for name, d := range decoders {
+		for _, value := range []string{"1556298970945", "2019-04-26T17:16:10.945Z"} {
+			msg := &sarama.ConsumerMessage{
+				Value:     []byte(`{ "field": "value" }`),
+				Timestamp: testNowValue,
+				Headers: []*sarama.RecordHeader{
+					{Key: []byte("ts"), Value: []byte(value)},
+				},
+			}
+			e := decodeSingleEvent(t, d, msg)
+			if !e.Timestamp.Equal(ts) {
+				t.Errorf("%s: expected %v", name, ts)
+				t.Errorf("%s:    found %v", name, e.Timestamp)
+			}
+		}
+	}
+}
+
+func TestDecoderWithInvalidHeaderTimestamp(t *testing.T) {
+	ts := time.Date(2019, time.April, 26, 17, 16, 10, 945958000, time.UTC)
+	d := newPlainDecoder("ts", common.TsLayout)
+	msg := &sarama.ConsumerMessage{
+		Value:     []byte(`mymessage`),
+		Timestamp: ts,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("ts"), Value: []byte("yesterday")},
+		},
+	}
+	e := decodeSingleEvent(t, d, msg)
+	if e.Timestamp != ts {
+		t.Errorf("Expected %v", ts)
+		t.Errorf("   found %v", e.Timestamp)
+	}
+}
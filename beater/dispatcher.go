@@ -0,0 +1,84 @@
+package beater
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/Shopify/sarama"
+)
+
+// Message dispatcher
+//
+// Distributes fetched messages over worker channels. Unless ordering is
+// disabled, messages sharing the same partition (or key) always end up on
+// the same worker, so they are decoded and published in fetch order.
+type dispatcher struct {
+	channels []chan *trackedMessage
+	shardFn  func(msg *sarama.ConsumerMessage) uint32
+}
+
+func newDispatcher(ordering string, workers, bufferSize int) (*dispatcher, error) {
+	var shardFn func(msg *sarama.ConsumerMessage) uint32
+	switch ordering {
+	case "none":
+		workers = 1 // single channel shared by all workers
+	case "partition":
+		shardFn = partitionShard
+	case "key":
+		shardFn = keyShard
+	default:
+		return nil, fmt.Errorf("error in configuration, unknown ordering: '%s'", ordering)
+	}
+
+	d := &dispatcher{
+		channels: make([]chan *trackedMessage, workers),
+		shardFn:  shardFn,
+	}
+	for i := range d.channels {
+		d.channels[i] = make(chan *trackedMessage, bufferSize)
+	}
+	return d, nil
+}
+
+// Dispatch sends message to the worker channel, blocks if channel is full
+func (d *dispatcher) Dispatch(msg *trackedMessage) {
+	i := 0
+	if d.shardFn != nil {
+		i = int(d.shardFn(msg.ConsumerMessage) % uint32(len(d.channels)))
+	}
+	d.channels[i] <- msg
+}
+
+// Channel returns channel to be consumed by given worker
+func (d *dispatcher) Channel(worker int) <-chan *trackedMessage {
+	return d.channels[worker%len(d.channels)]
+}
+
+// Close closes all worker channels
+func (d *dispatcher) Close() {
+	for _, ch := range d.channels {
+		close(ch)
+	}
+}
+
+func partitionShard(msg *sarama.ConsumerMessage) uint32 {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(msg.Partition))
+
+	h := fnv.New32a()
+	h.Write([]byte(msg.Topic))
+	h.Write(buf[:])
+	return h.Sum32()
+}
+
+// Messages without key are kept in partition order
+func keyShard(msg *sarama.ConsumerMessage) uint32 {
+	if len(msg.Key) == 0 {
+		return partitionShard(msg)
+	}
+
+	h := fnv.New32a()
+	h.Write(msg.Key)
+	return h.Sum32()
+}
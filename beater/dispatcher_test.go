@@ -0,0 +1,125 @@
+// +build !integration
+
+package beater
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func dispatchTestMessages(d *dispatcher, msgs []*sarama.ConsumerMessage) map[*sarama.ConsumerMessage]int {
+	for _, msg := range msgs {
+		d.Dispatch(&trackedMessage{ConsumerMessage: msg})
+	}
+	d.Close()
+
+	workers := map[*sarama.ConsumerMessage]int{}
+	for i := range d.channels {
+		for msg := range d.Channel(i) {
+			workers[msg.ConsumerMessage] = i
+		}
+	}
+	return workers
+}
+
+func TestDispatcherUnknownOrdering(t *testing.T) {
+	if _, err := newDispatcher("random", 4, 16); err == nil {
+		t.Error("Error expected for unknown ordering")
+	}
+}
+
+func TestDispatcherPartitionOrdering(t *testing.T) {
+	d, err := newDispatcher("partition", 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []*sarama.ConsumerMessage
+	for offset := int64(0); offset < 8; offset++ {
+		for partition := int32(0); partition < 4; partition++ {
+			msgs = append(msgs, &sarama.ConsumerMessage{
+				Topic:     "watch",
+				Partition: partition,
+				Offset:    offset,
+			})
+		}
+	}
+
+	workers := dispatchTestMessages(d, msgs)
+	partitions := map[int32]int{}
+	for _, msg := range msgs {
+		if worker, seen := partitions[msg.Partition]; seen && worker != workers[msg] {
+			t.Errorf("Partition %d dispatched to workers %d and %d", msg.Partition, worker, workers[msg])
+		}
+		partitions[msg.Partition] = workers[msg]
+	}
+}
+
+func TestDispatcherKeyOrdering(t *testing.T) {
+	d, err := newDispatcher("key", 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 32; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{
+			Topic:     "watch",
+			Partition: int32(i % 3),
+			Key:       []byte(fmt.Sprintf("key-%d", i%5)),
+			Offset:    int64(i),
+		})
+	}
+
+	workers := dispatchTestMessages(d, msgs)
+	keys := map[string]int{}
+	for _, msg := range msgs {
+		if worker, seen := keys[string(msg.Key)]; seen && worker != workers[msg] {
+			t.Errorf("Key %s dispatched to workers %d and %d", msg.Key, worker, workers[msg])
+		}
+		keys[string(msg.Key)] = workers[msg]
+	}
+}
+
+func TestDispatcherSpread(t *testing.T) {
+	for _, ordering := range []string{"partition", "key"} {
+		d, err := newDispatcher(ordering, 4, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// distinct partitions, distinct keys of a single partition
+		var msgs []*sarama.ConsumerMessage
+		for i := 0; i < 64; i++ {
+			msg := &sarama.ConsumerMessage{Topic: "watch", Partition: int32(i)}
+			if ordering == "key" {
+				msg.Partition, msg.Key = 0, []byte(fmt.Sprintf("key-%d", i))
+			}
+			msgs = append(msgs, msg)
+		}
+
+		counts := make([]int, 4)
+		for _, worker := range dispatchTestMessages(d, msgs) {
+			counts[worker]++
+		}
+		for _, n := range counts {
+			if n < 8 || n > 24 {
+				t.Errorf("%s: uneven spread over workers %v", ordering, counts)
+				break
+			}
+		}
+	}
+}
+
+func TestDispatcherNoOrdering(t *testing.T) {
+	d, err := newDispatcher("none", 4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Channel(0) != d.Channel(3) {
+		t.Error("All workers expected to share single channel")
+	}
+}
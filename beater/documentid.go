@@ -0,0 +1,130 @@
+package beater
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+)
+
+// Deterministic document ID
+//
+// ID is derived from Kafka coordinates (topic-partition-offset), message key
+// or decoded event field, optionally SHA-1 hashed, so re-delivered messages
+// map to the same document. Events without key or field get no ID, index of
+// event is appended to ID of messages decoded into many events.
+type documentIDWriter struct {
+	source string // "coordinates", "key" or "field"
+	field  string
+	hash   bool
+	target string
+}
+
+// Returns nil writer if document IDs are disabled. Key and field IDs are
+// updated by later messages, which requires an output indexing documents
+// instead of creating them, see honoursOpType.
+func newDocumentIDWriter(cfg config.DocumentIDConfig, output string) (*documentIDWriter, error) {
+	switch cfg.Source {
+	case "none":
+		return nil, nil
+	case "coordinates":
+	case "key", "field":
+		if cfg.Source == "field" && cfg.Field == "" {
+			return nil, fmt.Errorf("error in configuration, document_id.source: field requires document_id.field")
+		}
+		if !honoursOpType(output) {
+			return nil, fmt.Errorf("error in configuration, document_id.source: %s requires logstash output, "+
+				"output '%s' keeps the first version of a document", cfg.Source, output)
+		}
+	default:
+		return nil, fmt.Errorf("error in configuration, unknown document_id.source: '%s'", cfg.Source)
+	}
+	if cfg.Target == "" {
+		return nil, fmt.Errorf("error in configuration, document_id.target is required")
+	}
+
+	return &documentIDWriter{
+		source: cfg.Source,
+		field:  cfg.Field,
+		hash:   cfg.Hash,
+		target: cfg.Target,
+	}, nil
+}
+
+// Sets ID of i-th of n events decoded from message, events already carrying
+// an ID (compacted topics) are left as is
+func (w *documentIDWriter) Write(event *beat.Event, msg *sarama.ConsumerMessage, i, n int) {
+	if w == nil || hasEventValue(event, w.target) {
+		return
+	}
+	if id, ok := w.id(event, msg, i, n); ok {
+		putEventValue(event, w.target, id)
+	}
+}
+
+func (w *documentIDWriter) id(event *beat.Event, msg *sarama.ConsumerMessage, i, n int) (string, bool) {
+	var id string
+	switch w.source {
+	case "coordinates":
+		id = msg.Topic + "-" + strconv.Itoa(int(msg.Partition)) + "-" + strconv.FormatInt(msg.Offset, 10)
+
+	case "key":
+		if msg.Key == nil {
+			return "", false
+		}
+		id = string(msg.Key)
+
+	case "field":
+		v, err := event.Fields.GetValue(w.field)
+		if err != nil || v == nil {
+			return "", false
+		}
+		id = formatID(v)
+	}
+	if id == "" {
+		return "", false
+	}
+	if n > 1 {
+		id += "-" + strconv.Itoa(i) // message decoded into many events
+	}
+	return documentID(id, w.hash), true
+}
+
+// Field value as ID, floats are formatted without exponent
+func formatID(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Raw or SHA-1 hex digest of document ID
+func documentID(id string, hash bool) string {
+	if !hash {
+		return id
+	}
+	sum := sha1.Sum([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether event has value at key, @metadata. prefix checks event metadata
+func hasEventValue(event *beat.Event, key string) bool {
+	fields := event.Fields
+	if strings.HasPrefix(key, "@metadata.") {
+		fields, key = event.Meta, strings.TrimPrefix(key, "@metadata.")
+	}
+	_, err := fields.GetValue(key)
+	return err == nil
+}
@@ -0,0 +1,173 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Beater with given document_id settings, key and field IDs require logstash output
+func newTestDocumentIDBeater(t *testing.T, settings map[string]interface{}) *Kafkabeat {
+	bt, err := newTestOutputBeater(t, "logstash", map[string]interface{}{"document_id": settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bt
+}
+
+func TestDocumentID(t *testing.T) {
+	for _, test := range []struct {
+		settings map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"source": "coordinates"}, "watch-3-42"},
+		{map[string]interface{}{"source": "coordinates", "hash": true}, "8391fcb7b0a5fcd03937da48758c4d17f0be5e4e"},
+		{map[string]interface{}{"source": "key"}, "user-1"},
+		{map[string]interface{}{"source": "key", "hash": true}, "9dfffe450852c20c8876f6e5a37da6e469bf2c9c"},
+		{map[string]interface{}{"source": "field", "field": "order.id"}, "1001"},
+		{map[string]interface{}{"source": "field", "field": "order.id", "hash": true}, "dd01903921ea24941c26a48f2cec24e0bb0e8cc7"},
+	} {
+		bt := newTestDocumentIDBeater(t, test.settings)
+		client := &testClient{}
+		bt.pipeline = client
+
+		msg := newTestMetadataMessage()
+		msg.Value = []byte(`{"order":{"id":1001}}`)
+		runTestWorker(bt, msg)
+
+		if len(client.events) != 1 {
+			t.Fatalf("Expected single event, found %d", len(client.events))
+		}
+		if id, _ := client.events[0].Meta.GetValue("id"); id != test.expected {
+			t.Errorf("%v: expected id %s, found %v", test.settings, test.expected, id)
+		}
+	}
+}
+
+func TestDocumentIDNumberFormat(t *testing.T) {
+	bt := newTestDocumentIDBeater(t, map[string]interface{}{"source": "field", "field": "id"})
+	client := &testClient{}
+	bt.pipeline = client
+
+	values := map[string]string{
+		`{"id":12345678}`:             "12345678",
+		`{"id":9007199254740993}`:     "9007199254740993", // 2^53+1
+		`{"id":18446744073709551615}`: "18446744073709551615",
+		`{"id":12345678.5}`:           "12345678.5",
+		`{"id":1e21}`:                 "1000000000000000000000",
+		`{"id":"9007199254740993"}`:   "9007199254740993",
+	}
+	var msgs []*sarama.ConsumerMessage
+	var expected []string
+	for value, id := range values {
+		msgs = append(msgs, &sarama.ConsumerMessage{Topic: "orders", Offset: int64(len(msgs)), Value: []byte(value)})
+		expected = append(expected, id)
+	}
+	runTestWorker(bt, msgs...)
+
+	for i, id := range expected {
+		if found, _ := client.events[i].Meta.GetValue("id"); found != id {
+			t.Errorf("%s: expected id %s, found %v", msgs[i].Value, id, found)
+		}
+	}
+}
+
+func TestDocumentIDPlain(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"codec":       "plain",
+		"document_id": map[string]interface{}{"source": "coordinates", "target": "@metadata._id"},
+	})
+	client := &testClient{}
+	bt.pipeline = client
+
+	runTestWorker(bt,
+		&sarama.ConsumerMessage{Topic: "orders-eu", Partition: 0, Offset: 7, Value: []byte("hello")},
+		&sarama.ConsumerMessage{Topic: "orders-eu", Partition: 1, Offset: 7, Value: []byte("hello")},
+	)
+	for i, expected := range []string{"orders-eu-0-7", "orders-eu-1-7"} {
+		if id, _ := client.events[i].Meta.GetValue("_id"); id != expected {
+			t.Errorf("Expected id %s, found %v", expected, id)
+		}
+	}
+}
+
+func TestDocumentIDMissing(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		{"source": "key"},
+		{"source": "field", "field": "order.id"},
+	} {
+		bt := newTestDocumentIDBeater(t, settings)
+		client := &testClient{}
+		bt.pipeline = client
+
+		runTestWorker(bt, &sarama.ConsumerMessage{Topic: "watch", Value: []byte(`{"field":"value"}`)})
+		if _, err := client.events[0].Meta.GetValue("id"); err == nil {
+			t.Errorf("%v: unexpected id of event without key or field", settings)
+		}
+	}
+}
+
+func TestDocumentIDManyEvents(t *testing.T) {
+	for _, source := range []string{"coordinates", "key", "field"} {
+		w, err := newDocumentIDWriter(config.DocumentIDConfig{
+			Source: source,
+			Field:  "order.id",
+			Target: "@metadata.id",
+		}, "logstash")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := &sarama.ConsumerMessage{Topic: "orders", Partition: 1, Offset: 7, Key: []byte("1001")}
+		ids := map[interface{}]bool{}
+		for i := 0; i < 2; i++ {
+			event := beat.Event{Fields: common.MapStr{"order": common.MapStr{"id": 1001}}}
+			w.Write(&event, msg, i, 2)
+			id, _ := event.Meta.GetValue("id")
+			ids[id] = true
+		}
+		if len(ids) != 2 {
+			t.Errorf("%s: expected distinct ids of events, found %v", source, ids)
+		}
+	}
+}
+
+func TestDocumentIDOutput(t *testing.T) {
+	for _, source := range []string{"key", "field"} {
+		settings := map[string]interface{}{
+			"document_id": map[string]interface{}{"source": source, "field": "order.id"},
+		}
+		if _, err := newTestOutputBeater(t, "elasticsearch", settings); err == nil {
+			t.Errorf("%s: error expected for elasticsearch output", source)
+		}
+	}
+
+	settings := map[string]interface{}{
+		"document_id": map[string]interface{}{"source": "coordinates"},
+	}
+	if _, err := newTestOutputBeater(t, "elasticsearch", settings); err != nil {
+		t.Errorf("Coordinates expected to be accepted with elasticsearch output: %v", err)
+	}
+}
+
+func TestDocumentIDConfigInvalid(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		{"source": "uuid"},
+		{"source": "field"},
+		{"source": "key", "target": ""},
+	} {
+		cfg, err := common.NewConfigFrom(map[string]interface{}{"document_id": settings})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("Error expected for %v", settings)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package beater
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Record headers decoder
+type headerDecoder struct {
+	include map[string]bool // nil includes all headers
+	codec   string
+	codecs  map[string]string
+}
+
+func newHeaderDecoder(cfg config.HeadersConfig) (*headerDecoder, error) {
+	d := &headerDecoder{
+		codec:  cfg.Codec,
+		codecs: cfg.Codecs,
+	}
+	if err := validateHeaderCodec(d.codec); err != nil {
+		return nil, err
+	}
+	for _, codec := range d.codecs {
+		if err := validateHeaderCodec(codec); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.Include) > 0 {
+		d.include = map[string]bool{}
+		for _, name := range cfg.Include {
+			d.include[name] = true
+		}
+	}
+	return d, nil
+}
+
+func validateHeaderCodec(codec string) error {
+	switch codec {
+	case "string", "base64", "json":
+		return nil
+	default:
+		return fmt.Errorf("error in configuration, unknown headers codec: '%s'", codec)
+	}
+}
+
+// Decode returns included headers, nil if there are none
+func (d *headerDecoder) Decode(headers []*sarama.RecordHeader) common.MapStr {
+	var fields common.MapStr
+	for _, h := range headers {
+		name := string(h.Key)
+		if d.include != nil && !d.include[name] {
+			continue
+		}
+
+		if fields == nil {
+			fields = common.MapStr{}
+		}
+		fields[name] = d.decodeValue(name, h.Value)
+	}
+	return fields
+}
+
+func (d *headerDecoder) decodeValue(name string, value []byte) interface{} {
+	codec, exists := d.codecs[name]
+	if !exists {
+		codec = d.codec
+	}
+
+	switch codec {
+	case "base64":
+		return base64.StdEncoding.EncodeToString(value)
+	case "json":
+		var v interface{}
+		if err := json.Unmarshal(value, &v); err == nil {
+			return v
+		}
+	}
+	return string(value) // invalid json is kept as string
+}
+
+// Header value by name, last one wins for repeated headers
+func headerValue(headers []*sarama.RecordHeader, name string) ([]byte, bool) {
+	var value []byte
+	found := false
+	for _, h := range headers {
+		if string(h.Key) == name {
+			value, found = h.Value, true
+		}
+	}
+	return value, found
+}
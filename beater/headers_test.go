@@ -0,0 +1,91 @@
+// +build !integration
+
+package beater
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+var testHeaders = []*sarama.RecordHeader{
+	{Key: []byte("tenant"), Value: []byte("acme")},
+	{Key: []byte("schema"), Value: []byte(`{"id":12,"name":"order"}`)},
+	{Key: []byte("trace"), Value: []byte{0xde, 0xad, 0xbe, 0xef}},
+}
+
+func TestHeaderDecoderAll(t *testing.T) {
+	d, err := newHeaderDecoder(config.HeadersConfig{Codec: "string"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := common.MapStr{
+		"tenant": "acme",
+		"schema": `{"id":12,"name":"order"}`,
+		"trace":  "\xde\xad\xbe\xef",
+	}
+	if headers := d.Decode(testHeaders); !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", headers)
+	}
+}
+
+func TestHeaderDecoderIncludeAndCodecs(t *testing.T) {
+	d, err := newHeaderDecoder(config.HeadersConfig{
+		Include: []string{"schema", "trace", "missing"},
+		Codec:   "json",
+		Codecs:  map[string]string{"trace": "base64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := common.MapStr{
+		"schema": map[string]interface{}{"id": float64(12), "name": "order"},
+		"trace":  "3q2+7w==",
+	}
+	if headers := d.Decode(testHeaders); !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", headers)
+	}
+}
+
+func TestHeaderDecoderInvalidJSON(t *testing.T) {
+	d, err := newHeaderDecoder(config.HeadersConfig{Codec: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := d.Decode(testHeaders[:1])
+	if headers["tenant"] != "acme" {
+		t.Errorf("Expected invalid json kept as string, found %v", headers["tenant"])
+	}
+}
+
+func TestHeaderDecoderNoHeaders(t *testing.T) {
+	d, err := newHeaderDecoder(config.HeadersConfig{Codec: "string", Include: []string{"missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if headers := d.Decode(testHeaders); headers != nil {
+		t.Errorf("Expected no headers, found %v", headers)
+	}
+	if headers := d.Decode(nil); headers != nil {
+		t.Errorf("Expected no headers, found %v", headers)
+	}
+}
+
+func TestHeaderDecoderUnknownCodec(t *testing.T) {
+	if _, err := newHeaderDecoder(config.HeadersConfig{Codec: "hex"}); err == nil {
+		t.Error("Error expected for unknown codec")
+	}
+	if _, err := newHeaderDecoder(config.HeadersConfig{Codec: "string", Codecs: map[string]string{"a": "xml"}}); err == nil {
+		t.Error("Error expected for unknown codec")
+	}
+}
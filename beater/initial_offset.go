@@ -0,0 +1,170 @@
+package beater
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Initial offset of partitions: newest, oldest, last N messages of partition
+// (newest-N) or first message at or after timestamp (RFC3339)
+type initialOffset struct {
+	position  int64 // sarama.OffsetNewest or sarama.OffsetOldest
+	lag       int64
+	timestamp time.Time
+}
+
+func parseInitialOffset(s string) (*initialOffset, error) {
+	switch {
+	case s == "newest":
+		return &initialOffset{position: sarama.OffsetNewest}, nil
+	case s == "oldest":
+		return &initialOffset{position: sarama.OffsetOldest}, nil
+	case strings.HasPrefix(s, "newest-"):
+		lag, err := strconv.ParseInt(strings.TrimPrefix(s, "newest-"), 10, 64)
+		if err != nil || lag <= 0 {
+			return nil, fmt.Errorf("error in configuration, invalid offset: '%s'", s)
+		}
+		// partitions of topics created after startup start from oldest
+		return &initialOffset{position: sarama.OffsetOldest, lag: lag}, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("error in configuration, unknown offset: '%s'", s)
+	}
+	return &initialOffset{position: sarama.OffsetOldest, timestamp: ts}, nil
+}
+
+// Whether initial offset is resolved by consumer on its own
+func (o *initialOffset) Builtin() bool {
+	return o.lag == 0 && o.timestamp.IsZero()
+}
+
+// Offset of next message to consume from partition
+func (o *initialOffset) Resolve(client sarama.Client, topic string, partition int32) (int64, error) {
+	if !o.timestamp.IsZero() {
+		if !client.Config().Version.IsAtLeast(sarama.V0_10_1_0) {
+			return 0, fmt.Errorf("offset by timestamp requires kafka 0.10.1 or newer")
+		}
+		ms := o.timestamp.UnixNano() / int64(time.Millisecond)
+		offset, err := client.GetOffset(topic, partition, ms)
+		if err != nil || offset >= 0 {
+			return offset, err
+		}
+		// no message at or after timestamp
+		return client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil || o.position == sarama.OffsetNewest && o.lag == 0 {
+		return newest, err
+	}
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil || o.lag == 0 || newest-o.lag < oldest {
+		return oldest, err
+	}
+	return newest - o.lag, nil
+}
+
+// Commits initial offsets of consumer group partitions before the group is
+// joined, partitions with committed offset are skipped unless forced.
+// Offsets are committed outside of group generation, so the group must not
+// have active members.
+func seekInitialOffsets(
+	client sarama.Client,
+	group string,
+	topics []string,
+	offset *initialOffset,
+	force bool,
+	logger *logp.Logger,
+) error {
+	om, err := sarama.NewOffsetManagerFromClient(group, client)
+	if err != nil {
+		return err
+	}
+
+	var poms []sarama.PartitionOffsetManager
+	seek := func() error {
+		for _, topic := range topics {
+			list, err := client.Partitions(topic)
+			if err != nil {
+				return err
+			}
+			for _, partition := range list {
+				pom, err := om.ManagePartition(topic, partition)
+				if err != nil {
+					return err
+				}
+				poms = append(poms, pom)
+
+				committed, _ := pom.NextOffset()
+				if committed >= 0 && !force {
+					continue
+				}
+
+				next, err := offset.Resolve(client, topic, partition)
+				if err != nil {
+					return fmt.Errorf("failed to resolve initial offset of topic: %s, partition: %d, %v", topic, partition, err)
+				}
+				if next > committed {
+					pom.MarkOffset(next, "")
+				} else {
+					pom.ResetOffset(next, "")
+				}
+				logger.Infof("topic: %s, partition: %d, initial offset: %d", topic, partition, next)
+			}
+		}
+		return nil
+	}
+	err = seek()
+
+	// flushes offsets
+	om.Close()
+	for _, pom := range poms {
+		if closeErr := pom.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to commit initial offsets: %v", closeErr)
+		}
+	}
+	return err
+}
+
+// Topics subscribed by name or pattern
+func subscribedTopics(client sarama.Client, names []string, cfg *cluster.Config) ([]string, error) {
+	topics := append([]string(nil), names...)
+	whitelist, blacklist := cfg.Group.Topics.Whitelist, cfg.Group.Topics.Blacklist
+	if whitelist == nil {
+		return topics, nil
+	}
+
+	all, err := client.Topics()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+	for _, topic := range all {
+		if !known[topic] && matchTopic(topic, whitelist, blacklist) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics[len(names):])
+	return topics, nil
+}
+
+func matchTopic(topic string, whitelist, blacklist *regexp.Regexp) bool {
+	if blacklist != nil && blacklist.MatchString(topic) {
+		return false
+	}
+	return whitelist.MatchString(topic)
+}
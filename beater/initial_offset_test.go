@@ -0,0 +1,142 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+func TestInitialOffsetParse(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for s, expected := range map[string]initialOffset{
+		"newest":               {position: sarama.OffsetNewest},
+		"oldest":               {position: sarama.OffsetOldest},
+		"newest-100":           {position: sarama.OffsetOldest, lag: 100},
+		"2024-05-01T00:00:00Z": {position: sarama.OffsetOldest, timestamp: ts},
+	} {
+		offset, err := parseInitialOffset(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if offset.position != expected.position || offset.lag != expected.lag || !offset.timestamp.Equal(expected.timestamp) {
+			t.Errorf("%s: expected %+v, found %+v", s, expected, *offset)
+		}
+		if builtin := expected.lag == 0 && expected.timestamp.IsZero(); offset.Builtin() != builtin {
+			t.Errorf("%s: expected builtin %v", s, builtin)
+		}
+	}
+
+	for _, s := range []string{"latest", "newest-", "newest-0", "newest--1", "newest-x", "2024-05-01"} {
+		if _, err := parseInitialOffset(s); err == nil {
+			t.Errorf("Error expected for %s", s)
+		}
+	}
+}
+
+// Broker with topic logs of 2 partitions, first one has offset committed
+// by group kafkabeat
+func newTestOffsetsBroker(t *testing.T, offsets *sarama.MockOffsetResponse) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("logs", 0, broker.BrokerID()).
+			SetLeader("logs", 1, broker.BrokerID()),
+		"OffsetRequest": offsets.
+			SetOffset("logs", 0, sarama.OffsetOldest, 0).
+			SetOffset("logs", 0, sarama.OffsetNewest, 100).
+			SetOffset("logs", 1, sarama.OffsetOldest, 50).
+			SetOffset("logs", 1, sarama.OffsetNewest, 55),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "kafkabeat", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("kafkabeat", "logs", 0, 5, "", sarama.ErrNoError).
+			SetOffset("kafkabeat", "logs", 1, -1, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+	return broker
+}
+
+// Seeks initial offsets, returns committed offsets by partition
+func runTestSeek(t *testing.T, broker *sarama.MockBroker, offset string, force bool) map[int32]int64 {
+	initial, err := parseInitialOffset(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_10_1_0
+	cfg.Consumer.Offsets.Initial = initial.position
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := seekInitialOffsets(client, "kafkabeat", []string{"logs"}, initial, force, logp.NewLogger("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	committed := map[int32]int64{}
+	for _, entry := range broker.History() {
+		req, ok := entry.Request.(*sarama.OffsetCommitRequest)
+		if !ok {
+			continue
+		}
+		for _, partition := range []int32{0, 1} {
+			if offset, _, err := req.Offset("logs", partition); err == nil {
+				committed[partition] = offset
+			}
+		}
+	}
+	return committed
+}
+
+func TestInitialOffsetSeek(t *testing.T) {
+	for _, test := range []struct {
+		offset   string
+		force    bool
+		expected map[int32]int64
+	}{
+		{"newest-10", false, map[int32]int64{1: 50}},
+		{"newest-10", true, map[int32]int64{0: 90, 1: 50}},
+		{"newest", true, map[int32]int64{0: 100, 1: 55}},
+		{"oldest", true, map[int32]int64{0: 0, 1: 50}},
+	} {
+		broker := newTestOffsetsBroker(t, sarama.NewMockOffsetResponse(t).SetVersion(1))
+		committed := runTestSeek(t, broker, test.offset, test.force)
+		broker.Close()
+
+		if len(committed) != len(test.expected) {
+			t.Errorf("%s: expected %v committed, found %v", test.offset, test.expected, committed)
+			continue
+		}
+		for partition, offset := range test.expected {
+			if committed[partition] != offset {
+				t.Errorf("%s: expected %v committed, found %v", test.offset, test.expected, committed)
+			}
+		}
+	}
+}
+
+func TestInitialOffsetSeekTimestamp(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	ms := ts.UnixNano() / int64(time.Millisecond)
+
+	// no message after timestamp in partition 1, newest is used
+	offsets := sarama.NewMockOffsetResponse(t).SetVersion(1).
+		SetOffset("logs", 0, ms, 42).
+		SetOffset("logs", 1, ms, -1)
+	broker := newTestOffsetsBroker(t, offsets)
+	defer broker.Close()
+
+	committed := runTestSeek(t, broker, ts.Format(time.RFC3339), true)
+	if committed[0] != 42 || committed[1] != 55 {
+		t.Errorf("Expected offsets 42 and 55 committed, found %v", committed)
+	}
+}
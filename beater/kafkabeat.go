@@ -2,6 +2,9 @@ package beater
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/arkady-emelyanov/kafkabeat/config"
@@ -11,21 +14,48 @@ import (
 
 	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
 	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/paths"
 )
 
+// Kafka consumer, consumer group or static partition assignment
+type kafkaConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan error
+	Notifications() <-chan *cluster.Notification
+	MarkPartitionOffset(topic string, partition int32, offset int64, metadata string)
+	CommitOffsets() error
+	Close() error
+}
+
 type Kafkabeat struct {
 	done   chan struct{}
 	logger *logp.Logger
-	mode   beat.PublishMode
+
+	failed   chan struct{} // closed on unrecoverable error
+	failure  error
+	failOnce sync.Once
+
+	mode beat.PublishMode
 
 	bConfig config.Config   // beats config
 	kConfig *cluster.Config // kafka config
 
 	pipeline beat.Client
-	consumer *cluster.Consumer
+	consumer kafkaConsumer
+	messages *dispatcher
+	offsets  *offsetTracker
+	workers  sync.WaitGroup
 
-	codec decoder
+	initial    *initialOffset
+	until      *initialOffset
+	backfill   *backfill // run_once only
+	codec      decoder
+	topics     *topicRouter
+	metadata   *metadataWriter
+	documentID *documentIDWriter
+	deadLetter *deadLetterWriter
 }
 
 // Creates beater
@@ -40,26 +70,144 @@ func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
 	kConfig.ChannelBufferSize = bConfig.ChannelBufferSize
 	kConfig.Consumer.MaxWaitTime = time.Millisecond * 500
 	kConfig.Consumer.Return.Errors = true
+	kConfig.Group.Return.Notifications = true
+
+	// on rebalance, in-flight events of revoked partitions have
+	// dwell time to be acknowledged before offsets are committed
+	kConfig.Group.Offsets.Synchronization.DwellTime = bConfig.RebalanceDwellTime
+
+	// kafka protocol version, "auto" is resolved on startup
+	if bConfig.Version != "auto" {
+		version, err := parseKafkaVersion(bConfig.Version)
+		if err != nil {
+			return nil, err
+		}
+		kConfig.Version = version
+	}
+
+	// broker connection security
+	tlsConfig, err := tlscommon.LoadTLSConfig(bConfig.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("error in configuration, invalid ssl settings: %v", err)
+	}
+	if tlsConfig != nil {
+		kConfig.Net.TLS.Enable = true
+		kConfig.Net.TLS.Config = tlsConfig.BuildModuleConfig("")
+	}
+
+	// SASL authentication
+	if bConfig.Username != "" {
+		switch mechanism := strings.ToUpper(bConfig.SASL.Mechanism); mechanism {
+		case "PLAIN":
+			kConfig.Net.SASL.Enable = true
+			kConfig.Net.SASL.User = bConfig.Username
+			kConfig.Net.SASL.Password = bConfig.Password
+		case sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+			// SaslAuthenticate request requires Kafka 1.0+
+			kConfig.Net.SASL.Enable = true
+			kConfig.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+			kConfig.Net.SASL.User = bConfig.Username
+			kConfig.Net.SASL.Password = bConfig.Password
+			kConfig.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClientGenerator(kConfig.Net.SASL.Mechanism)
+		default:
+			return nil, fmt.Errorf("error in configuration, unknown sasl.mechanism: '%s'", bConfig.SASL.Mechanism)
+		}
+	}
 
-	// initial offset handling
-	switch bConfig.Offset {
-	case "newest":
-		kConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
-	case "oldest":
-		kConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	// topics by regular expression, topics created later on are picked up
+	// on metadata refresh
+	if bConfig.TopicsRefreshInterval <= 0 {
+		return nil, fmt.Errorf("error in configuration, topics_refresh_interval must be positive")
+	}
+	kConfig.Metadata.RefreshFrequency = bConfig.TopicsRefreshInterval
+	if bConfig.TopicsPattern != "" {
+		pattern, err := regexp.Compile(bConfig.TopicsPattern)
+		if err != nil {
+			return nil, fmt.Errorf("error in configuration, invalid topics_pattern: %v", err)
+		}
+		kConfig.Group.Topics.Whitelist = pattern
+		kConfig.Metadata.Full = true
+
+		if !cfg.HasField("topics") {
+			bConfig.Topics = nil // no default topic
+		}
+	}
+	if bConfig.TopicsExcludePattern != "" {
+		if bConfig.TopicsPattern == "" {
+			return nil, fmt.Errorf("error in configuration, topics_exclude_pattern requires topics_pattern")
+		}
+		pattern, err := regexp.Compile(bConfig.TopicsExcludePattern)
+		if err != nil {
+			return nil, fmt.Errorf("error in configuration, invalid topics_exclude_pattern: %v", err)
+		}
+		kConfig.Group.Topics.Blacklist = pattern
+	}
+
+	// consumer group or static partitions, all partitions of topics
+	// unless partitions are given
+	switch bConfig.Mode {
+	case "group":
+		if len(bConfig.Partitions) > 0 {
+			return nil, fmt.Errorf("error in configuration, partitions require mode: assign")
+		}
+		if len(topicNames(bConfig.Topics)) == 0 && bConfig.TopicsPattern == "" {
+			return nil, fmt.Errorf("error in configuration, topics or topics_pattern is required")
+		}
+	case "assign":
+		if len(bConfig.Partitions) == 0 && len(topicNames(bConfig.Topics)) == 0 {
+			return nil, fmt.Errorf("error in configuration, mode: assign requires partitions or topics")
+		}
+		if bConfig.TopicsPattern != "" {
+			return nil, fmt.Errorf("error in configuration, topics_pattern is not supported by mode: assign")
+		}
 	default:
-		return nil, fmt.Errorf("error in configuration, unknown offset: '%s'", bConfig.Offset)
+		return nil, fmt.Errorf("error in configuration, unknown mode: '%s'", bConfig.Mode)
 	}
 
-	// codec to use
-	var codec decoder
-	switch bConfig.Codec {
-	case "json":
-		codec = newJSONDecoder(bConfig.TimestampKey, bConfig.TimestampLayout)
-	case "plain":
-		codec = newPlainDecoder()
+	// initial offset handling, timestamp and newest-N are resolved
+	// per partition on startup
+	initial, err := parseInitialOffset(bConfig.Offset)
+	if err != nil {
+		return nil, err
+	}
+	kConfig.Consumer.Offsets.Initial = initial.position
+
+	// run_once consumes up to newest offsets on startup or until timestamp
+	until := &initialOffset{position: sarama.OffsetNewest}
+	if bConfig.Until != "" {
+		if !bConfig.RunOnce {
+			return nil, fmt.Errorf("error in configuration, until requires run_once")
+		}
+		ts, err := time.Parse(time.RFC3339, bConfig.Until)
+		if err != nil {
+			return nil, fmt.Errorf("error in configuration, invalid until: '%s'", bConfig.Until)
+		}
+		until.timestamp = ts
+	}
+
+	// closed on Stop, interrupts retries of external services
+	done := make(chan struct{})
+
+	// codecs to use, global and topic specific, compacted topics and
+	// document IDs depend on the output
+	var output string
+	if b != nil && b.Config != nil {
+		output = b.Config.Output.Name()
+	}
+	codecs := newCodecFactory(bConfig.SchemaRegistry, bConfig.DocumentID, output, done)
+	codec, err := codecs.Create(bConfig.CodecConfig)
+	if err != nil {
+		return nil, err
+	}
+	topics, err := newTopicRouter(bConfig.Topics, bConfig.CodecConfig, codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch bConfig.OnDecodeError {
+	case "drop", "event", "fail":
 	default:
-		return nil, fmt.Errorf("error in configuration, unknown codec: '%s'", bConfig.Codec)
+		return nil, fmt.Errorf("error in configuration, unknown on_decode_error: '%s'", bConfig.OnDecodeError)
 	}
 
 	// publish_mode
@@ -79,46 +227,118 @@ func New(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
 		bConfig.ChannelWorkers = 1
 	}
 
+	// kafka record metadata, key and headers
+	key, err := newKeyDecoder(bConfig.KeyCodec)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := newHeaderDecoder(bConfig.Headers)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := newMetadataWriter(
+		bConfig.KafkaMetadata,
+		key, bConfig.KeyTarget,
+		headers, bConfig.Headers.Target,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	documentID, err := newDocumentIDWriter(bConfig.DocumentID, output)
+	if err != nil {
+		return nil, err
+	}
+
+	if bConfig.DeadLetter.Topic != "" && bConfig.DeadLetter.File.Path != "" {
+		return nil, fmt.Errorf("error in configuration, dead_letter.topic and dead_letter.file.path are mutually exclusive")
+	}
+
+	// ordering
+	messages, err := newDispatcher(bConfig.Ordering, bConfig.ChannelWorkers, bConfig.ChannelBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
 	// return beat
 	bt := &Kafkabeat{
-		done:    make(chan struct{}),
-		logger:  logp.NewLogger("kafkabeat"),
-		mode:    mode,
-		bConfig: bConfig,
-		kConfig: kConfig,
-		codec:   codec,
+		done:       done,
+		failed:     make(chan struct{}),
+		logger:     logp.NewLogger("kafkabeat"),
+		mode:       mode,
+		bConfig:    bConfig,
+		kConfig:    kConfig,
+		messages:   messages,
+		initial:    initial,
+		until:      until,
+		codec:      codec,
+		topics:     topics,
+		metadata:   metadata,
+		documentID: documentID,
 	}
+	bt.offsets = newOffsetTracker(bt.commitOffset)
 	return bt, nil
 }
 
 func (bt *Kafkabeat) Run(b *beat.Beat) error {
 	var err error
 
+	if bt.bConfig.Version == "auto" {
+		bt.kConfig.Version, err = detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config)
+		if err != nil {
+			return err
+		}
+		bt.logger.Infof("detected kafka version: %v", bt.kConfig.Version)
+	}
+
+	// start dead-letter queue
+	dlq := bt.bConfig.DeadLetter
+	switch {
+	case dlq.Topic != "":
+		brokers := dlq.Brokers
+		if len(brokers) == 0 {
+			brokers = bt.bConfig.Brokers
+		}
+		producer, err := newDeadLetterProducer(brokers, bt.kConfig.Config)
+		if err != nil {
+			return err
+		}
+		sink := &deadLetterTopic{topic: dlq.Topic, producer: producer}
+		bt.deadLetter = newDeadLetterWriter(dlq, sink, bt.done)
+
+	case dlq.File.Path != "":
+		sink, err := newDeadLetterFile(dlq.File)
+		if err != nil {
+			return err
+		}
+		bt.deadLetter = newDeadLetterWriter(dlq, sink, bt.done)
+	}
+
 	// start kafka consumer
-	bt.consumer, err = cluster.NewConsumer(
-		bt.bConfig.Brokers,
-		bt.bConfig.Group,
-		bt.bConfig.Topics,
-		bt.kConfig,
-	)
+	if bt.bConfig.Mode == "assign" {
+		err = bt.startStatic()
+	} else {
+		err = bt.startGroup()
+	}
 	if err != nil {
+		bt.closeDeadLetter()
 		return err
 	}
 
-	// start beats pipeline
-	bt.pipeline, err = b.Publisher.ConnectWith(
-		beat.ClientConfig{
-			PublishMode: bt.mode,
-		},
-	)
-	if err != nil {
+	// start beats pipeline, offsets are committed on ACK only
+	if err := bt.connect(b.Publisher, bt.ackEvents); err != nil {
+		bt.consumer.Close()
+		bt.closeDeadLetter()
 		return err
 	}
 
 	// run workers
+	go bt.fetchFn()
+
 	bt.logger.Info("spawning channel workers: ", bt.bConfig.ChannelWorkers)
 	for i := 0; i < bt.bConfig.ChannelWorkers; i++ {
-		go bt.workerFn()
+		bt.workers.Add(1)
+		go bt.workerFn(bt.messages.Channel(i))
 	}
 
 	// run loop
@@ -126,30 +346,368 @@ func (bt *Kafkabeat) Run(b *beat.Beat) error {
 	for {
 		select {
 		case <-bt.done:
-			bt.consumer.Close()
+			bt.shutdown()
+			return nil
+
+		case <-bt.failed:
+			bt.logger.Error(bt.failure)
+			bt.shutdown()
+			return bt.failure
+
+		case <-bt.backfill.Done():
+			bt.logger.Info("run once, assigned partitions are consumed up to end offsets")
+			bt.shutdown()
 			return nil
 
 		case err := <-bt.consumer.Errors():
 			bt.logger.Error(err.Error())
+
+		case n := <-bt.consumer.Notifications():
+			bt.handleRebalance(n)
+		}
+	}
+}
+
+// Joins consumer group, partitions are seeked and end offsets snapshotted
+// before joining
+func (bt *Kafkabeat) startGroup() error {
+	if err := bt.prepareGroup(); err != nil {
+		return err
+	}
+
+	consumer, err := cluster.NewConsumer(
+		bt.bConfig.Brokers,
+		bt.bConfig.Group,
+		topicNames(bt.bConfig.Topics),
+		bt.kConfig,
+	)
+	if err != nil {
+		return err
+	}
+	bt.consumer = consumer
+	return nil
+}
+
+// Starts consuming static partitions from offsets of the registry file
+func (bt *Kafkabeat) startStatic() error {
+	client, err := sarama.NewClient(bt.bConfig.Brokers, &bt.kConfig.Config)
+	if err != nil {
+		return err
+	}
+	registrar, err := newRegistrar(paths.Resolve(paths.Data, bt.bConfig.RegistryFile), bt.bConfig.RegistryFlush)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("failed to load registry file: %v", err)
+	}
+
+	partitions, offsets, err := bt.prepareStatic(client, registrar)
+	if err != nil {
+		registrar.Close()
+		client.Close()
+		return err
+	}
+
+	consumer, err := newStaticConsumer(client, offsets, registrar, bt.initial.position, bt.logger)
+	if err != nil {
+		return err
+	}
+	bt.consumer = consumer
+	currentAssignment.Set(partitions)
+	return nil
+}
+
+// Resolves static partitions and their offsets, in run_once mode end offsets
+// of partitions are snapshotted.
+func (bt *Kafkabeat) prepareStatic(client sarama.Client, registrar *registrar) (map[string][]int32, map[topicPartition]int64, error) {
+	partitions, err := staticPartitions(client, bt.bConfig.Partitions, topicNames(bt.bConfig.Topics))
+	if err != nil {
+		return nil, nil, err
+	}
+	offsets, err := resolveStaticOffsets(client, partitions, registrar, bt.initial, bt.bConfig.ForceInitialOffset)
+	if err != nil || !bt.bConfig.RunOnce {
+		return partitions, offsets, err
+	}
+
+	bt.backfill = newBackfill()
+	for tp, start := range offsets {
+		end, err := bt.until.Resolve(client, tp.topic, tp.partition)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve end offset of topic: %s, partition: %d, %v", tp.topic, tp.partition, err)
 		}
+		bt.backfill.Set(tp.topic, tp.partition, start, end)
 	}
+	bt.backfill.Assign(partitions)
+	bt.logger.Infof("run once, messages to consume: %d", bt.backfill.Pending())
+	return partitions, offsets, nil
 }
 
-func (bt *Kafkabeat) workerFn() {
+// Commits initial offsets of subscribed partitions, partitions with committed
+// offsets are reset only if force_initial_offset is set. In run_once mode
+// end offsets of partitions are snapshotted.
+func (bt *Kafkabeat) prepareGroup() error {
+	seek := !bt.initial.Builtin() || bt.bConfig.ForceInitialOffset
+	if !seek && !bt.bConfig.RunOnce {
+		return nil
+	}
+
+	client, err := sarama.NewClient(bt.bConfig.Brokers, &bt.kConfig.Config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	topics, err := subscribedTopics(client, topicNames(bt.bConfig.Topics), bt.kConfig)
+	if err != nil {
+		return err
+	}
+	if seek {
+		bt.logger.Infof("seeking initial offset '%s' of topics: %v", bt.bConfig.Offset, topics)
+		err := seekInitialOffsets(client, bt.bConfig.Group, topics, bt.initial, bt.bConfig.ForceInitialOffset, bt.logger)
+		if err != nil {
+			return err
+		}
+	}
+	if bt.bConfig.RunOnce {
+		bt.backfill, err = snapshotBackfill(client, bt.bConfig.Group, topics, bt.initial, bt.until)
+		if err != nil {
+			return err
+		}
+		bt.logger.Infof("run once, messages to consume: %d", bt.backfill.Pending())
+	}
+	return nil
+}
+
+func (bt *Kafkabeat) handleRebalance(n *cluster.Notification) {
+	switch n.Type {
+	case cluster.RebalanceStart:
+		bt.logger.Infof("rebalance started, releasing partitions: %v", n.Current)
+
+	case cluster.RebalanceOK:
+		bt.logger.Infof("rebalance finished, claimed: %v, released: %v, current: %v",
+			n.Claimed, n.Released, n.Current)
+
+		// offsets of released partitions were committed during dwell time,
+		// anything still in-flight is owned by another consumer now
+		for topic, list := range n.Released {
+			for _, partition := range list {
+				bt.offsets.Revoke(topic, partition)
+			}
+		}
+		bt.backfill.Assign(n.Current)
+
+		added, removed := currentAssignment.Set(n.Current)
+		if len(added) > 0 {
+			bt.logger.Infof("topics added to assignment: %v", added)
+		}
+		if len(removed) > 0 {
+			bt.logger.Infof("topics removed from assignment: %v", removed)
+		}
+		rebalances.Inc()
+
+	case cluster.RebalanceError:
+		bt.logger.Errorf("rebalance failed, current partitions: %v", n.Current)
+	}
+}
+
+// Registers fetched messages in fetch order and hands them over to workers
+func (bt *Kafkabeat) fetchFn() {
+	defer bt.messages.Close()
+
 	for {
-		msg := <-bt.consumer.Messages()
-		if msg == nil {
-			break
+		select {
+		case <-bt.done:
+			return
+
+		case <-bt.failed:
+			return
+
+		case <-bt.backfill.Done():
+			return
+
+		case msg, ok := <-bt.consumer.Messages():
+			if !ok {
+				return
+			}
+			if bt.backfill.Skip(msg) {
+				continue // past end offset of run_once
+			}
+			bt.messages.Dispatch(bt.offsets.Track(msg))
+		}
+	}
+}
+
+func (bt *Kafkabeat) workerFn(messages <-chan *trackedMessage) {
+	defer bt.workers.Done()
+
+	for tracked := range messages {
+		msg := tracked.ConsumerMessage
+		select {
+		case <-bt.failed:
+			continue // drain, offsets of remaining messages are not committed
+		default:
+		}
+
+		codec, pipeline := bt.route(msg.Topic)
+		events, err := codec.Decode(msg)
+		if _, ok := err.(*decodeError); err != nil && !ok {
+			bt.logger.Errorf("failed to process topic: %s, partition: %d, offset: %d, %v",
+				msg.Topic, msg.Partition, msg.Offset, err)
+			continue // offset is left uncommitted
 		}
+		if err != nil {
+			decodeErrors.Inc()
 
-		if event := bt.codec.Decode(msg); event != nil {
-			bt.pipeline.Publish(*event)
+			var ok bool
+			if events, ok = bt.handleDecodeError(msg, err); !ok {
+				continue // offset is left uncommitted
+			}
 		}
-		bt.consumer.MarkOffset(msg, "")
+		if len(events) == 0 {
+			bt.offsets.Ack(tracked)
+			continue
+		}
+
+		bt.offsets.Expect(tracked, len(events))
+		for i := range events {
+			bt.metadata.Write(&events[i], msg)
+			bt.documentID.Write(&events[i], msg, i, len(events))
+			events[i].Private = tracked
+			pipeline.Publish(events[i])
+		}
+	}
+}
+
+// Codec and publisher pipeline client of topic
+func (bt *Kafkabeat) route(topic string) (decoder, beat.Client) {
+	if route := bt.topics.Lookup(topic); route != nil {
+		return route.codec, route.pipeline
+	}
+	return bt.codec, bt.pipeline
+}
+
+// Connects publisher pipeline clients, global and topic specific ones
+func (bt *Kafkabeat) connect(p beat.Pipeline, ack func([]interface{})) error {
+	cfg := beat.ClientConfig{
+		PublishMode: bt.mode,
+		ACKEvents:   ack,
+		WaitClose:   bt.bConfig.ShutdownTimeout,
+	}
+
+	var err error
+	if bt.pipeline, err = p.ConnectWith(cfg); err != nil {
+		return err
+	}
+	if err := bt.topics.Connect(p, cfg); err != nil {
+		bt.closePipeline()
+		return err
+	}
+	return nil
+}
+
+// Closes publisher pipeline clients, waits for pending events to be acknowledged
+func (bt *Kafkabeat) closePipeline() {
+	closeClients(append([]beat.Client{bt.pipeline}, bt.topics.Clients()...))
+}
+
+// Writes message failed to decode to dead-letter queue and applies
+// on_decode_error, returns false if message must not be committed.
+func (bt *Kafkabeat) handleDecodeError(msg *sarama.ConsumerMessage, err error) ([]beat.Event, bool) {
+	if bt.deadLetter != nil && !bt.deadLetter.Write(msg, err) {
+		return nil, false // beat was stopped before write succeeded
+	}
+
+	switch bt.bConfig.OnDecodeError {
+	case "event":
+		return []beat.Event{newDecodeErrorEvent(msg, err, bt.bConfig.DecodeErrorTag)}, true
+
+	case "fail":
+		bt.fail(fmt.Errorf("failed to decode topic: %s, partition: %d, offset: %d, %v",
+			msg.Topic, msg.Partition, msg.Offset, err))
+		return nil, false
+
+	default:
+		if bt.deadLetter == nil {
+			bt.logger.Warnf("dropping message topic: %s, partition: %d, offset: %d, %v",
+				msg.Topic, msg.Partition, msg.Offset, err)
+		}
+		return nil, true
+	}
+}
+
+// Stops the beat with error, first error wins
+func (bt *Kafkabeat) fail(err error) {
+	bt.failOnce.Do(func() {
+		bt.failure = err
+		close(bt.failed)
+	})
+}
+
+// Called by the publisher pipeline once events are acknowledged by the output
+func (bt *Kafkabeat) ackEvents(data []interface{}) {
+	for _, private := range data {
+		if msg, ok := private.(*trackedMessage); ok {
+			bt.offsets.Ack(msg)
+		}
+	}
+}
+
+func (bt *Kafkabeat) commitOffset(topic string, partition int32, offset int64) {
+	bt.consumer.MarkPartitionOffset(topic, partition, offset, "")
+	bt.backfill.Commit(topic, partition, offset)
+}
+
+// Orderly shutdown: fetching is already stopped by closing bt.done,
+// drain workers, wait for pending ACKs, commit final offsets and leave group.
+func (bt *Kafkabeat) shutdown() {
+	timeout := bt.bConfig.ShutdownTimeout
+
+	bt.logger.Info("waiting for channel workers to drain")
+	if waitTimeout(&bt.workers, timeout) {
+		bt.closeDeadLetter() // workers may still be writing otherwise
+	} else {
+		bt.logger.Warnf("channel workers not drained within %v", timeout)
+	}
+
+	// blocks up to shutdown_timeout waiting for ACKs of published events
+	bt.logger.Info("waiting for pending events to be acknowledged")
+	bt.closePipeline()
+
+	bt.logger.Info("committing offsets")
+	if err := bt.consumer.CommitOffsets(); err != nil {
+		bt.logger.Errorf("failed to commit offsets: %v", err)
+	}
+
+	bt.logger.Info("leaving consumer group")
+	if err := bt.consumer.Close(); err != nil {
+		bt.logger.Errorf("failed to close consumer: %v", err)
+	}
+}
+
+func (bt *Kafkabeat) closeDeadLetter() {
+	if bt.deadLetter == nil {
+		return
+	}
+	if err := bt.deadLetter.Close(); err != nil {
+		bt.logger.Errorf("failed to close dead-letter producer: %v", err)
 	}
 }
 
 func (bt *Kafkabeat) Stop() {
-	bt.pipeline.Close()
 	close(bt.done)
 }
+
+// Waits for wait group, returns false on timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,604 @@
+// +build !integration
+
+package beater
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/keystore"
+)
+
+func newTestBeater(t *testing.T, settings map[string]interface{}) *Kafkabeat {
+	cfg, err := common.NewConfigFrom(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bt, err := New(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bt.(*Kafkabeat)
+}
+
+// Beater of beat publishing to given output
+func newTestOutputBeater(t *testing.T, output string, settings map[string]interface{}) (*Kafkabeat, error) {
+	outputCfg, err := common.NewConfigFrom(map[string]interface{}{
+		"output": map[string]interface{}{output: map[string]interface{}{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &beat.Beat{Config: &beat.BeatConfig{}}
+	if err := outputCfg.Unpack(b.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := common.NewConfigFrom(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := New(b, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return bt.(*Kafkabeat), nil
+}
+
+func newTestVersionBroker(t *testing.T, listener net.Listener) *sarama.MockBroker {
+	broker := sarama.NewMockBrokerListener(t, 1, listener)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockWrapper(&sarama.ApiVersionsResponse{
+			ApiVersions: []*sarama.ApiVersionsResponseBlock{
+				{ApiKey: apiKeyFetch, MinVersion: 0, MaxVersion: 8},
+			},
+		}),
+	})
+	return broker
+}
+
+// Test certificate authority issuing certificates for 127.0.0.1
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	dir, err := ioutil.TempDir("", "kafkabeat-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{dir: dir}
+	ca.cert, ca.key = ca.issue(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "kafkabeat test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+func (ca *testCA) Close() {
+	os.RemoveAll(ca.dir)
+}
+
+func (ca *testCA) issue(t *testing.T, name string, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.writePEM(t, name+".pem", "CERTIFICATE", der)
+	ca.writePEM(t, name+".key", "EC PRIVATE KEY", keyDER)
+	return cert, key
+}
+
+func (ca *testCA) writePEM(t *testing.T, name, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(ca.path(name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+func (ca *testCA) listen(t *testing.T, clientAuth tls.ClientAuthType) net.Listener {
+	ca.issue(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	cert, err := tls.LoadX509KeyPair(ca.path("server.pem"), ca.path("server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   clientAuth,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func TestTLSConnection(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.Close()
+
+	broker := newTestVersionBroker(t, ca.listen(t, tls.NoClientCert))
+	defer broker.Close()
+
+	bt := newTestBeater(t, map[string]interface{}{
+		"brokers": []string{broker.Addr()},
+		"ssl": map[string]interface{}{
+			"certificate_authorities": []string{ca.path("ca.pem")},
+		},
+	})
+	if !bt.kConfig.Net.TLS.Enable {
+		t.Fatal("TLS expected to be enabled")
+	}
+
+	version, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != sarama.V2_0_0_0 {
+		t.Errorf("Expected %v", sarama.V2_0_0_0)
+		t.Errorf("   found %v", version)
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.Close()
+
+	broker := newTestVersionBroker(t, ca.listen(t, tls.RequireAndVerifyClientCert))
+	defer broker.Close()
+
+	ca.issue(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "kafkabeat"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	bt := newTestBeater(t, map[string]interface{}{
+		"brokers": []string{broker.Addr()},
+		"ssl": map[string]interface{}{
+			"certificate_authorities": []string{ca.path("ca.pem")},
+			"certificate":             ca.path("client.pem"),
+			"key":                     ca.path("client.key"),
+		},
+	})
+
+	if _, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSUnknownAuthority(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.Close()
+
+	// handshake only, broker would report failed handshake as test error
+	listener := ca.listen(t, tls.NoClientCert)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	bt := newTestBeater(t, map[string]interface{}{
+		"brokers": []string{listener.Addr().String()},
+		"ssl":     map[string]interface{}{},
+	})
+	_, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config)
+	if err == nil || !strings.Contains(err.Error(), "unknown authority") {
+		t.Errorf("Expected unknown authority error, found %v", err)
+	}
+}
+
+func TestTLSVerificationDisabled(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.Close()
+
+	broker := newTestVersionBroker(t, ca.listen(t, tls.NoClientCert))
+	defer broker.Close()
+
+	bt := newTestBeater(t, map[string]interface{}{
+		"brokers": []string{broker.Addr()},
+		"ssl": map[string]interface{}{
+			"verification_mode": "none",
+		},
+	})
+	if _, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSInvalidConfig(t *testing.T) {
+	cfg, err := common.NewConfigFrom(map[string]interface{}{
+		"ssl": map[string]interface{}{
+			"certificate_authorities": []string{"/nonexistent/ca.pem"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(nil, cfg); err == nil {
+		t.Error("Error expected for missing certificate authority")
+	}
+}
+
+// SASL/PLAIN stand-in, authenticates connections before handing them over to mock broker
+type saslListener struct {
+	net.Listener
+	user     string
+	password string
+}
+
+func (l *saslListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := l.authenticate(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func (l *saslListener) authenticate(conn net.Conn) error {
+	// SaslHandshake request: api key, version, correlation id, client id, mechanism
+	req, err := readSASLFrame(conn)
+	if err != nil {
+		return err
+	}
+	if len(req) < 10 || binary.BigEndian.Uint16(req) != 17 {
+		return errors.New("SaslHandshake request expected")
+	}
+	correlationID := req[4:8]
+	clientIDLen := int(binary.BigEndian.Uint16(req[8:]))
+	mechanism := string(req[12+clientIDLen:])
+
+	var errCode int16
+	if mechanism != "PLAIN" {
+		errCode = int16(sarama.ErrUnsupportedSASLMechanism)
+	}
+
+	res := new(bytes.Buffer)
+	res.Write(correlationID)
+	binary.Write(res, binary.BigEndian, errCode)
+	binary.Write(res, binary.BigEndian, int32(1))
+	binary.Write(res, binary.BigEndian, int16(len("PLAIN")))
+	res.WriteString("PLAIN")
+	if err := writeSASLFrame(conn, res.Bytes()); err != nil || errCode != 0 {
+		return errors.New("SASL handshake failed")
+	}
+
+	// PLAIN token: authzid, authcid, password
+	token, err := readSASLFrame(conn)
+	if err != nil {
+		return err
+	}
+	if string(token) != "\x00"+l.user+"\x00"+l.password {
+		return errors.New("invalid credentials")
+	}
+	return writeSASLFrame(conn, nil)
+}
+
+func readSASLFrame(conn net.Conn) ([]byte, error) {
+	var size int32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	_, err := io.ReadFull(conn, buf)
+	return buf, err
+}
+
+func writeSASLFrame(conn net.Conn, data []byte) error {
+	if err := binary.Write(conn, binary.BigEndian, int32(len(data))); err != nil {
+		return err
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+func newTestSASLBroker(t *testing.T) *sarama.MockBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestVersionBroker(t, &saslListener{
+		Listener: listener,
+		user:     "kafkabeat",
+		password: "secret",
+	})
+}
+
+func TestSASLPlain(t *testing.T) {
+	broker := newTestSASLBroker(t)
+	defer broker.Close()
+
+	bt := newTestBeater(t, map[string]interface{}{
+		"brokers":  []string{broker.Addr()},
+		"username": "kafkabeat",
+		"password": "secret",
+	})
+	if !bt.kConfig.Net.SASL.Enable {
+		t.Fatal("SASL expected to be enabled")
+	}
+
+	if _, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSASLInvalidCredentials(t *testing.T) {
+	broker := newTestSASLBroker(t)
+	defer broker.Close()
+
+	bt := newTestBeater(t, map[string]interface{}{
+		"brokers":  []string{broker.Addr()},
+		"username": "kafkabeat",
+		"password": "invalid",
+	})
+	if _, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config); err == nil {
+		t.Error("Error expected for invalid credentials")
+	}
+}
+
+func TestSASLPasswordFromKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkabeat-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := keystore.NewFileKeystore(filepath.Join(dir, "kafkabeat.keystore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Store("KAFKA_PASSWORD", []byte("secret"))
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keystore resolver is global, restored to empty keystore resolving
+	// environment variables only, as without keystore
+	empty, err := keystore.NewFileKeystore(filepath.Join(dir, "empty.keystore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	common.OverwriteConfigOpts(keystore.ConfigOpts(store))
+	defer common.OverwriteConfigOpts(keystore.ConfigOpts(empty))
+
+	bt := newTestBeater(t, map[string]interface{}{
+		"username": "kafkabeat",
+		"password": "${KAFKA_PASSWORD}",
+	})
+	if bt.kConfig.Net.SASL.Password != "secret" {
+		t.Errorf("Expected password resolved from keystore, found '%s'", bt.kConfig.Net.SASL.Password)
+	}
+}
+
+func TestSASLMechanism(t *testing.T) {
+	for _, mechanism := range []string{"GSSAPI", "OAUTHBEARER"} {
+		cfg, err := common.NewConfigFrom(map[string]interface{}{
+			"username":       "kafkabeat",
+			"password":       "secret",
+			"sasl.mechanism": mechanism,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("Error expected for sasl.mechanism '%s'", mechanism)
+		}
+	}
+}
+
+// Publisher pipeline client collecting published events
+type testClient struct {
+	mu     sync.Mutex
+	events []beat.Event
+}
+
+func (c *testClient) Publish(e beat.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, e)
+}
+
+func (c *testClient) PublishAll(events []beat.Event) {
+	for _, e := range events {
+		c.Publish(e)
+	}
+}
+
+func (c *testClient) Close() error {
+	return nil
+}
+
+// Runs single worker over given messages
+func runTestWorker(bt *Kafkabeat, msgs ...*sarama.ConsumerMessage) {
+	messages := make(chan *trackedMessage, len(msgs))
+	for _, msg := range msgs {
+		messages <- bt.offsets.Track(msg)
+	}
+	close(messages)
+
+	bt.workers.Add(1)
+	bt.workerFn(messages)
+}
+
+func TestOnDecodeErrorEvent(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"on_decode_error":  "event",
+		"decode_error_tag": "_jsonparsefailure",
+	})
+	tracker, commits := newTestOffsetTracker()
+	bt.offsets = tracker
+	client := &testClient{}
+	bt.pipeline = client
+
+	ts := time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC)
+	msg := &sarama.ConsumerMessage{Topic: "watch", Offset: 1, Value: []byte(`{"field":`), Timestamp: ts}
+	runTestWorker(bt, msg)
+
+	if len(client.events) != 1 {
+		t.Fatalf("Expected error event, found %v", client.events)
+	}
+	e := client.events[0]
+	expected := common.MapStr{
+		"message": `{"field":`,
+		"error": common.MapStr{
+			"message": "unexpected end of JSON input",
+			"type":    "json_decode_error",
+		},
+		"tags": []string{"_jsonparsefailure"},
+	}
+	if !reflect.DeepEqual(e.Fields, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", e.Fields)
+	}
+	if !e.Timestamp.Equal(ts) {
+		t.Errorf("Expected kafka timestamp %v, found %v", ts, e.Timestamp)
+	}
+
+	// committed on ACK
+	if len(*commits) != 0 {
+		t.Fatalf("Offset must not be committed before ACK, found %v", *commits)
+	}
+	bt.ackEvents([]interface{}{e.Private})
+	if len(*commits) != 1 {
+		t.Errorf("Offset must be committed on ACK, found %v", *commits)
+	}
+}
+
+func TestOnDecodeErrorFail(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"on_decode_error": "fail",
+	})
+	tracker, commits := newTestOffsetTracker()
+	bt.offsets = tracker
+	client := &testClient{}
+	bt.pipeline = client
+
+	runTestWorker(bt,
+		&sarama.ConsumerMessage{Topic: "watch", Offset: 1, Value: []byte(`{"field":"value"}`)},
+		&sarama.ConsumerMessage{Topic: "watch", Offset: 2, Value: []byte(`{"field":`)},
+		&sarama.ConsumerMessage{Topic: "watch", Offset: 3, Value: []byte(`{"field":"value"}`)},
+	)
+
+	select {
+	case <-bt.failed:
+	default:
+		t.Fatal("Beat must be failed")
+	}
+	if bt.failure == nil || !strings.Contains(bt.failure.Error(), "offset: 2") {
+		t.Errorf("Unexpected failure %v", bt.failure)
+	}
+	if len(client.events) != 1 {
+		t.Errorf("Messages after failure must not be published, found %v", client.events)
+	}
+
+	bt.ackEvents([]interface{}{client.events[0].Private})
+	expected := []testCommit{{"watch", 0, 1}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestOnDecodeErrorDrop(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{})
+	tracker, commits := newTestOffsetTracker()
+	bt.offsets = tracker
+	client := &testClient{}
+	bt.pipeline = client
+
+	runTestWorker(bt, &sarama.ConsumerMessage{Topic: "watch", Offset: 1, Value: []byte(`{"field":`)})
+
+	if len(client.events) != 0 {
+		t.Errorf("No events expected, found %v", client.events)
+	}
+	expected := []testCommit{{"watch", 0, 1}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+
+	cfg, err := common.NewConfigFrom(map[string]interface{}{"on_decode_error": "ignore"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(nil, cfg); err == nil {
+		t.Error("Error expected for unknown on_decode_error")
+	}
+}
@@ -0,0 +1,49 @@
+package beater
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Message key decoder
+type keyDecoder func(key []byte) interface{}
+
+func newKeyDecoder(codec string) (keyDecoder, error) {
+	switch codec {
+	case "":
+		return nil, nil
+	case "plain":
+		return decodePlainKey, nil
+	case "json":
+		return decodeJSONKey, nil
+	case "base64":
+		return decodeBase64Key, nil
+	case "hex":
+		return decodeHexKey, nil
+	default:
+		return nil, fmt.Errorf("error in configuration, unknown key_codec: '%s'", codec)
+	}
+}
+
+func decodePlainKey(key []byte) interface{} {
+	return string(key)
+}
+
+// Invalid json is kept as string
+func decodeJSONKey(key []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(key, &v); err != nil {
+		return string(key)
+	}
+	return v
+}
+
+func decodeBase64Key(key []byte) interface{} {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func decodeHexKey(key []byte) interface{} {
+	return hex.EncodeToString(key)
+}
@@ -0,0 +1,48 @@
+// +build !integration
+
+package beater
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyDecoders(t *testing.T) {
+	cases := []struct {
+		codec    string
+		key      string
+		expected interface{}
+	}{
+		{"plain", "user-1", "user-1"},
+		{"json", `{"id":1}`, map[string]interface{}{"id": float64(1)}},
+		{"json", `"user-1"`, "user-1"},
+		{"json", `user-1`, "user-1"},
+		{"base64", "\x00\x01\xff", "AAH/"},
+		{"hex", "\x00\x01\xff", "0001ff"},
+	}
+
+	for _, c := range cases {
+		d, err := newKeyDecoder(c.codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := d([]byte(c.key)); !reflect.DeepEqual(v, c.expected) {
+			t.Errorf("%s: expected %v", c.codec, c.expected)
+			t.Errorf("%s:    found %v", c.codec, v)
+		}
+	}
+}
+
+func TestKeyDecoderDisabled(t *testing.T) {
+	d, err := newKeyDecoder("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != nil {
+		t.Error("No key decoder expected")
+	}
+
+	if _, err := newKeyDecoder("avro"); err == nil {
+		t.Error("Error expected for unknown key_codec")
+	}
+}
@@ -0,0 +1,101 @@
+package beater
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Kafka record metadata
+//
+// Adds origin of the event (topic, partition, offset, key, timestamp, headers)
+// either as kafka.* fields or as @metadata.kafka, which is available to
+// processors and outputs, but not indexed. Decoded key and headers can be
+// redirected to their own target fields.
+type metadataWriter struct {
+	target        string // "", "kafka" or "@metadata.kafka"
+	key           keyDecoder
+	keyTarget     string
+	headers       *headerDecoder
+	headersTarget string
+}
+
+func newMetadataWriter(
+	mode string,
+	key keyDecoder,
+	keyTarget string,
+	headers *headerDecoder,
+	headersTarget string,
+) (*metadataWriter, error) {
+	w := &metadataWriter{
+		key:           key,
+		keyTarget:     keyTarget,
+		headers:       headers,
+		headersTarget: headersTarget,
+	}
+	if key == nil {
+		w.keyTarget = "" // raw key is part of metadata
+	}
+
+	switch mode {
+	case "none":
+	case "fields":
+		w.target = "kafka"
+	case "metadata":
+		w.target = "@metadata.kafka"
+	default:
+		return nil, fmt.Errorf("error in configuration, unknown kafka_metadata: '%s'", mode)
+	}
+	return w, nil
+}
+
+func (w *metadataWriter) Write(event *beat.Event, msg *sarama.ConsumerMessage) {
+	if w.target == "" && w.keyTarget == "" && w.headersTarget == "" {
+		return
+	}
+
+	headers := w.headers.Decode(msg.Headers)
+	if w.target != "" {
+		m := common.MapStr{
+			"topic":     msg.Topic,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		}
+		if msg.Key != nil && w.keyTarget == "" {
+			m["key"] = string(msg.Key)
+		}
+		if !msg.Timestamp.IsZero() {
+			m["timestamp"] = common.Time(msg.Timestamp)
+		}
+		if headers != nil && w.headersTarget == "" {
+			m["headers"] = headers
+		}
+		putEventValue(event, w.target, m)
+	}
+
+	if msg.Key != nil && w.keyTarget != "" {
+		putEventValue(event, w.keyTarget, w.key(msg.Key))
+	}
+	if headers != nil && w.headersTarget != "" {
+		putEventValue(event, w.headersTarget, headers)
+	}
+}
+
+// Puts value into event fields, or into event metadata if key is prefixed with @metadata.
+func putEventValue(event *beat.Event, key string, v interface{}) {
+	if strings.HasPrefix(key, "@metadata.") {
+		if event.Meta == nil {
+			event.Meta = common.MapStr{}
+		}
+		event.Meta.Put(strings.TrimPrefix(key, "@metadata."), v)
+		return
+	}
+
+	if event.Fields == nil {
+		event.Fields = common.MapStr{}
+	}
+	event.Fields.Put(key, v)
+}
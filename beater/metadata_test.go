@@ -0,0 +1,171 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func newTestMetadataWriter(t *testing.T, mode string, headers config.HeadersConfig) *metadataWriter {
+	if headers.Codec == "" {
+		headers.Codec = "string"
+	}
+	d, err := newHeaderDecoder(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newMetadataWriter(mode, nil, "", d, headers.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func newTestMetadataMessage() *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic:     "watch",
+		Partition: 3,
+		Offset:    42,
+		Key:       []byte("user-1"),
+		Value:     []byte(`{"field":"value"}`),
+		Timestamp: time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("tenant"), Value: []byte("acme")},
+		},
+	}
+}
+
+func TestMetadataFields(t *testing.T) {
+	w := newTestMetadataWriter(t, "fields", config.HeadersConfig{})
+
+	msg := newTestMetadataMessage()
+	event := &beat.Event{Fields: common.MapStr{"field": "value"}}
+	w.Write(event, msg)
+
+	expected := common.MapStr{
+		"topic":     "watch",
+		"partition": int32(3),
+		"offset":    int64(42),
+		"key":       "user-1",
+		"timestamp": common.Time(msg.Timestamp),
+		"headers":   common.MapStr{"tenant": "acme"},
+	}
+	if !reflect.DeepEqual(event.Fields["kafka"], expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", event.Fields["kafka"])
+	}
+	if event.Meta != nil {
+		t.Errorf("Unexpected metadata %v", event.Meta)
+	}
+}
+
+func TestMetadataMeta(t *testing.T) {
+	w := newTestMetadataWriter(t, "metadata", config.HeadersConfig{})
+
+	event := &beat.Event{Fields: common.MapStr{"field": "value"}}
+	w.Write(event, &sarama.ConsumerMessage{Topic: "watch", Offset: 7})
+
+	expected := common.MapStr{
+		"topic":     "watch",
+		"partition": int32(0),
+		"offset":    int64(7),
+	}
+	if !reflect.DeepEqual(event.Meta["kafka"], expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", event.Meta["kafka"])
+	}
+	if _, exists := event.Fields["kafka"]; exists {
+		t.Error("Metadata must not be added to fields")
+	}
+}
+
+func TestMetadataNone(t *testing.T) {
+	w := newTestMetadataWriter(t, "none", config.HeadersConfig{})
+
+	event := &beat.Event{Fields: common.MapStr{"field": "value"}}
+	w.Write(event, newTestMetadataMessage())
+	if len(event.Fields) != 1 || event.Meta != nil {
+		t.Errorf("Unexpected event %v", event)
+	}
+
+	if _, err := newMetadataWriter("all", nil, "", nil, ""); err == nil {
+		t.Error("Error expected for unknown kafka_metadata")
+	}
+}
+
+func TestMetadataHeadersTarget(t *testing.T) {
+	w := newTestMetadataWriter(t, "fields", config.HeadersConfig{Target: "@metadata.headers"})
+
+	event := &beat.Event{Fields: common.MapStr{}}
+	w.Write(event, newTestMetadataMessage())
+
+	expected := common.MapStr{"tenant": "acme"}
+	if !reflect.DeepEqual(event.Meta["headers"], expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", event.Meta["headers"])
+	}
+	if _, err := event.Fields.GetValue("kafka.headers"); err == nil {
+		t.Error("Headers must not be added to kafka fields")
+	}
+
+	// headers only
+	w = newTestMetadataWriter(t, "none", config.HeadersConfig{Target: "kafka.headers"})
+	event = &beat.Event{Fields: common.MapStr{}}
+	w.Write(event, newTestMetadataMessage())
+
+	expected = common.MapStr{"kafka": common.MapStr{"headers": common.MapStr{"tenant": "acme"}}}
+	if !reflect.DeepEqual(event.Fields, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", event.Fields)
+	}
+}
+
+func TestMetadataKeyTarget(t *testing.T) {
+	d, err := newHeaderDecoder(config.HeadersConfig{Codec: "string"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newMetadataWriter("fields", decodeJSONKey, "kafka.key", d, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := newTestMetadataMessage()
+	msg.Key = []byte(`{"id":"user-1","region":"eu"}`)
+	event := &beat.Event{Fields: common.MapStr{}}
+	w.Write(event, msg)
+
+	key, err := event.Fields.GetValue("kafka.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"id": "user-1", "region": "eu"}
+	if !reflect.DeepEqual(key, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", key)
+	}
+	if topic, _ := event.Fields.GetValue("kafka.topic"); topic != "watch" {
+		t.Errorf("Expected kafka metadata to be kept, found %v", event.Fields)
+	}
+
+	// key only
+	w, err = newMetadataWriter("none", decodeHexKey, "entity_id", d, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event = &beat.Event{Fields: common.MapStr{}}
+	w.Write(event, msg)
+	if len(event.Fields) != 1 || event.Fields["entity_id"] != hex.EncodeToString(msg.Key) {
+		t.Errorf("Unexpected fields %v", event.Fields)
+	}
+}
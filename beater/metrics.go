@@ -0,0 +1,83 @@
+package beater
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/monitoring"
+)
+
+var (
+	consumerMetrics = monitoring.Default.NewRegistry("kafkabeat.consumer")
+	rebalances      = monitoring.NewInt(consumerMetrics, "rebalances")
+	partitions      = monitoring.NewInt(consumerMetrics, "partitions")
+	decodeErrors    = monitoring.NewInt(consumerMetrics, "decode_errors")
+
+	deadLetterMetrics  = monitoring.Default.NewRegistry("kafkabeat.dead_letter")
+	deadLetterMessages = monitoring.NewInt(deadLetterMetrics, "messages")
+	deadLetterErrors   = monitoring.NewInt(deadLetterMetrics, "errors")
+
+	currentAssignment = &assignment{}
+)
+
+func init() {
+	monitoring.NewFunc(consumerMetrics, "assignment", currentAssignment.Report, monitoring.Report)
+}
+
+// Topic/partitions currently claimed by the consumer
+type assignment struct {
+	mu         sync.Mutex
+	partitions map[string][]int32
+}
+
+// Replaces assignment, returns topics added to and removed from assignment
+func (a *assignment) Set(current map[string][]int32) ([]string, []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var added, removed []string
+	for topic := range current {
+		if _, exists := a.partitions[topic]; !exists {
+			added = append(added, topic)
+		}
+	}
+	for topic := range a.partitions {
+		if _, exists := current[topic]; !exists {
+			removed = append(removed, topic)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	total := 0
+	a.partitions = map[string][]int32{}
+	for topic, list := range current {
+		a.partitions[topic] = append([]int32(nil), list...)
+		total += len(list)
+	}
+	partitions.Set(int64(total))
+	return added, removed
+}
+
+func (a *assignment) Report(_ monitoring.Mode, V monitoring.Visitor) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	topics := make([]string, 0, len(a.partitions))
+	for topic := range a.partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+
+	for _, topic := range topics {
+		list := make([]string, len(a.partitions[topic]))
+		for i, p := range a.partitions[topic] {
+			list[i] = strconv.Itoa(int(p))
+		}
+		monitoring.ReportStringSlice(V, topic, list)
+	}
+}
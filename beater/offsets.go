@@ -0,0 +1,150 @@
+package beater
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// Partition coordinates
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// Offset commit callback
+type commitFunc func(topic string, partition int32, offset int64)
+
+// Offset tracker
+//
+// Messages are tracked in the order they were fetched from Kafka and
+// acknowledged in any order by the publisher pipeline. For every partition
+// only the highest offset with all preceding messages acknowledged is
+// committed, so out of order ACKs never move the committed offset past
+// a message which is still in-flight. Revoking a partition starts a new
+// assignment generation of it, late ACKs of messages tracked in an older
+// generation are ignored even if the partition is claimed again.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+	commitFn   commitFunc
+}
+
+// In-flight offsets of a single partition, sorted by offset
+type partitionOffsets struct {
+	generation uint64
+	pending    []pendingOffset
+}
+
+type pendingOffset struct {
+	offset int64
+	events int // outstanding ACKs, message can be decoded into many events
+}
+
+// Message tagged with assignment generation of its partition
+type trackedMessage struct {
+	*sarama.ConsumerMessage
+	generation uint64
+}
+
+func newOffsetTracker(commitFn commitFunc) *offsetTracker {
+	return &offsetTracker{
+		partitions: map[topicPartition]*partitionOffsets{},
+		commitFn:   commitFn,
+	}
+}
+
+// Track registers message as in-flight. Must be called in fetch order.
+func (t *offsetTracker) Track(msg *sarama.ConsumerMessage) *trackedMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tp := topicPartition{msg.Topic, msg.Partition}
+	p, exists := t.partitions[tp]
+	if !exists {
+		p = &partitionOffsets{}
+		t.partitions[tp] = p
+	}
+
+	// partition was re-consumed from an older position,
+	// everything pending after it will be fetched again
+	if n := len(p.pending); n > 0 && p.pending[n-1].offset >= msg.Offset {
+		i := p.search(msg.Offset)
+		p.pending = p.pending[:i]
+	}
+	p.pending = append(p.pending, pendingOffset{offset: msg.Offset, events: 1})
+	return &trackedMessage{ConsumerMessage: msg, generation: p.generation}
+}
+
+// Expect sets number of events message was decoded into, message is
+// processed once all of them are acknowledged. Must be called before
+// any of the events is published.
+func (t *offsetTracker) Expect(msg *trackedMessage, events int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, i := t.lookup(msg); p != nil {
+		p.pending[i].events = events
+	}
+}
+
+// Ack marks message event as processed and commits partition offset if possible.
+func (t *offsetTracker) Ack(msg *trackedMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, i := t.lookup(msg)
+	if p == nil {
+		return // not tracked (anymore)
+	}
+	if p.pending[i].events--; p.pending[i].events > 0 {
+		return
+	}
+
+	// advance over contiguous acknowledged head
+	n := 0
+	for n < len(p.pending) && p.pending[n].events <= 0 {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	committed := p.pending[n-1].offset
+	p.pending = p.pending[n:]
+	t.commitFn(msg.Topic, msg.Partition, committed)
+}
+
+// Revoke drops in-flight state of partition no longer claimed by consumer
+// and starts its next generation, late ACKs for the partition are ignored.
+func (t *offsetTracker) Revoke(topic string, partition int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, exists := t.partitions[topicPartition{topic, partition}]; exists {
+		p.generation++
+		p.pending = nil
+	}
+}
+
+// In-flight partition and index of message, nil if message is not tracked
+// or was tracked in previous generation of the partition
+func (t *offsetTracker) lookup(msg *trackedMessage) (*partitionOffsets, int) {
+	p, exists := t.partitions[topicPartition{msg.Topic, msg.Partition}]
+	if !exists || p.generation != msg.generation {
+		return nil, 0
+	}
+
+	i := p.search(msg.Offset)
+	if i == len(p.pending) || p.pending[i].offset != msg.Offset {
+		return nil, 0
+	}
+	return p, i
+}
+
+func (p *partitionOffsets) search(offset int64) int {
+	return sort.Search(len(p.pending), func(i int) bool {
+		return p.pending[i].offset >= offset
+	})
+}
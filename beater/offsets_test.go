@@ -0,0 +1,182 @@
+// +build !integration
+
+package beater
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+type testCommit struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+func newTestOffsetTracker() (*offsetTracker, *[]testCommit) {
+	commits := &[]testCommit{}
+	t := newOffsetTracker(func(topic string, partition int32, offset int64) {
+		*commits = append(*commits, testCommit{topic, partition, offset})
+	})
+	return t, commits
+}
+
+// Tracks messages of given offsets, returns them by offset
+func trackTestMessages(t *offsetTracker, topic string, partition int32, offsets ...int64) map[int64]*trackedMessage {
+	msgs := map[int64]*trackedMessage{}
+	for _, offset := range offsets {
+		msgs[offset] = t.Track(&sarama.ConsumerMessage{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    offset,
+		})
+	}
+	return msgs
+}
+
+func TestOffsetTrackerInOrderAck(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	msgs := trackTestMessages(tracker, "watch", 0, 1, 2, 3)
+
+	tracker.Ack(msgs[1])
+	tracker.Ack(msgs[2])
+	tracker.Ack(msgs[3])
+
+	expected := []testCommit{{"watch", 0, 1}, {"watch", 0, 2}, {"watch", 0, 3}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestOffsetTrackerOutOfOrderAck(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	msgs := trackTestMessages(tracker, "watch", 0, 10, 11, 15, 16)
+
+	tracker.Ack(msgs[16])
+	tracker.Ack(msgs[11])
+	if len(*commits) != 0 {
+		t.Fatalf("Offset must not be committed over a gap, found %v", *commits)
+	}
+
+	tracker.Ack(msgs[10])
+	tracker.Ack(msgs[15])
+
+	expected := []testCommit{{"watch", 0, 11}, {"watch", 0, 16}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestOffsetTrackerMultipleEvents(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	msgs := trackTestMessages(tracker, "watch", 0, 1, 2)
+
+	tracker.Expect(msgs[1], 3)
+	tracker.Ack(msgs[2])
+	tracker.Ack(msgs[1])
+	tracker.Ack(msgs[1])
+	if len(*commits) != 0 {
+		t.Fatalf("Offset must not be committed before all events are acknowledged, found %v", *commits)
+	}
+
+	tracker.Ack(msgs[1])
+
+	expected := []testCommit{{"watch", 0, 2}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestOffsetTrackerPartitionsAreIndependent(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	watch0 := trackTestMessages(tracker, "watch", 0, 1, 2)
+	watch1 := trackTestMessages(tracker, "watch", 1, 1, 2)
+	other := trackTestMessages(tracker, "other", 0, 1)
+
+	tracker.Ack(watch1[1])
+	tracker.Ack(other[1])
+	tracker.Ack(watch0[2])
+
+	expected := []testCommit{{"watch", 1, 1}, {"other", 0, 1}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestOffsetTrackerIgnoresUnknownAck(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	trackTestMessages(tracker, "watch", 0, 5)
+
+	for _, msg := range []*sarama.ConsumerMessage{
+		{Topic: "watch", Partition: 0, Offset: 4},
+		{Topic: "watch", Partition: 1, Offset: 5},
+		{Topic: "other", Partition: 0, Offset: 5},
+	} {
+		tracker.Ack(&trackedMessage{ConsumerMessage: msg})
+	}
+	if len(*commits) != 0 {
+		t.Errorf("Unexpected commits %v", *commits)
+	}
+}
+
+func TestOffsetTrackerRefetch(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	msgs := trackTestMessages(tracker, "watch", 0, 1, 2, 3)
+
+	// partition rewinds to 2, pending 2 and 3 are replaced
+	refetched := trackTestMessages(tracker, "watch", 0, 2, 3)
+	tracker.Ack(msgs[1])
+	tracker.Ack(refetched[2])
+
+	expected := []testCommit{{"watch", 0, 1}, {"watch", 0, 2}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestOffsetTrackerRevoke(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	watch0 := trackTestMessages(tracker, "watch", 0, 1, 2)
+	watch1 := trackTestMessages(tracker, "watch", 1, 1)
+
+	tracker.Revoke("watch", 0)
+	tracker.Ack(watch0[1])
+	tracker.Ack(watch1[1])
+
+	expected := []testCommit{{"watch", 1, 1}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
+
+func TestOffsetTrackerReclaim(t *testing.T) {
+	tracker, commits := newTestOffsetTracker()
+	revoked := trackTestMessages(tracker, "watch", 0, 1, 2, 3)
+
+	// partition is claimed again and re-consumed from committed offset,
+	// late ACKs of previous generation must not advance it
+	tracker.Revoke("watch", 0)
+	reclaimed := trackTestMessages(tracker, "watch", 0, 1, 2, 3)
+	tracker.Ack(revoked[1])
+	tracker.Ack(revoked[2])
+	tracker.Ack(revoked[3])
+	if len(*commits) != 0 {
+		t.Fatalf("Late ACKs of revoked partition must be ignored, found %v", *commits)
+	}
+
+	tracker.Ack(reclaimed[1])
+
+	expected := []testCommit{{"watch", 0, 1}}
+	if !reflect.DeepEqual(*commits, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", *commits)
+	}
+}
@@ -0,0 +1,591 @@
+package beater
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Protobuf schema
+//
+// Compiled FileDescriptorSet (protoc --include_imports --descriptor_set_out)
+// drives decoding of protobuf binary encoding straight into event fields,
+// following proto3 JSON mapping: fields are named by their JSON name, enums
+// become value names, 64 bit integers strings (or numbers), bytes base64
+// strings. Well-known types Timestamp becomes common.Time, Duration, Struct,
+// Value, ListValue and wrappers are mapped to their JSON representation.
+type protobufSchema struct {
+	messages      map[string]*protobufMessage // by fully qualified name
+	enums         map[string]map[int32]string
+	files         map[string]*descriptor.FileDescriptorProto // by message name
+	int64AsString bool
+}
+
+type protobufMessage struct {
+	name      string
+	fields    map[int32]*descriptor.FieldDescriptorProto
+	mapEntry  bool
+	timestamp string // JSON name of first google.protobuf.Timestamp field
+}
+
+// Loads FileDescriptorSet from file
+func loadProtobufSchema(filename string, int64AsString bool) (*protobufSchema, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &descriptor.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("invalid protobuf descriptor set %s: %v", filename, err)
+	}
+	return newProtobufSchema(set, int64AsString), nil
+}
+
+func newProtobufSchema(set *descriptor.FileDescriptorSet, int64AsString bool) *protobufSchema {
+	s := &protobufSchema{
+		messages:      map[string]*protobufMessage{},
+		enums:         map[string]map[int32]string{},
+		files:         map[string]*descriptor.FileDescriptorProto{},
+		int64AsString: int64AsString,
+	}
+	for _, file := range set.GetFile() {
+		prefix := file.GetPackage()
+		s.addEnums(prefix, file.GetEnumType())
+		for _, m := range file.GetMessageType() {
+			s.addMessage(file, prefix, m)
+		}
+	}
+	return s
+}
+
+func (s *protobufSchema) addMessage(file *descriptor.FileDescriptorProto, prefix string, m *descriptor.DescriptorProto) {
+	name := protobufFullName(prefix, m.GetName())
+	msg := &protobufMessage{
+		name:     name,
+		fields:   map[int32]*descriptor.FieldDescriptorProto{},
+		mapEntry: m.GetOptions().GetMapEntry(),
+	}
+	for _, f := range m.GetField() {
+		msg.fields[f.GetNumber()] = f
+		if msg.timestamp == "" && protobufIsTimestamp(f) {
+			msg.timestamp = protobufJSONName(f)
+		}
+	}
+	s.messages[name] = msg
+	s.files[name] = file
+
+	s.addEnums(name, m.GetEnumType())
+	for _, nested := range m.GetNestedType() {
+		s.addMessage(file, name, nested)
+	}
+}
+
+func (s *protobufSchema) addEnums(prefix string, enums []*descriptor.EnumDescriptorProto) {
+	for _, e := range enums {
+		values := map[int32]string{}
+		for _, v := range e.GetValue() {
+			if _, exists := values[v.GetNumber()]; !exists { // first alias wins
+				values[v.GetNumber()] = v.GetName()
+			}
+		}
+		s.enums[protobufFullName(prefix, e.GetName())] = values
+	}
+}
+
+func protobufFullName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// Message type by fully qualified name
+func (s *protobufSchema) Message(name string) (*protobufMessage, error) {
+	if m, exists := s.messages[strings.TrimPrefix(name, ".")]; exists {
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown protobuf message type: '%s'", name)
+}
+
+// Message type by Confluent message indexes, relative to the file defining
+// given message type: first index selects top-level message, following ones
+// nested messages.
+func (s *protobufSchema) MessageByIndexes(m *protobufMessage, indexes []int64) (*protobufMessage, error) {
+	file := s.files[m.name]
+	name := file.GetPackage()
+	types := file.GetMessageType()
+	for _, i := range indexes {
+		if i < 0 || i >= int64(len(types)) {
+			return nil, fmt.Errorf("message index %v out of range in %s", indexes, file.GetName())
+		}
+		name = protobufFullName(name, types[i].GetName())
+		types = types[i].GetNestedType()
+	}
+	return s.Message(name)
+}
+
+// Decodes protobuf binary encoded message
+func (s *protobufSchema) Decode(m *protobufMessage, data []byte) (common.MapStr, error) {
+	r := &protobufReader{schema: s, data: data}
+	fields := r.message(m)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return fields, nil
+}
+
+// Confluent protobuf wire format message indexes: zig-zag varint count
+// followed by indexes, a single zero stands for the first message.
+func confluentMessageIndexes(payload []byte) ([]int64, []byte, error) {
+	r := &avroReader{data: payload} // same zig-zag varint encoding
+	n := r.long()
+	if n < 0 || n > int64(len(r.data)) {
+		r.fail(fmt.Errorf("invalid message indexes count %d", n))
+	}
+	indexes := []int64{0}
+	if n > 0 {
+		indexes = make([]int64, n)
+		for i := range indexes {
+			indexes[i] = r.long()
+		}
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return indexes, r.data, nil
+}
+
+var errProtobufShortBuffer = errors.New("protobuf message is truncated")
+
+// Protobuf wire types
+const (
+	protobufVarint     = 0
+	protobufFixed64    = 1
+	protobufBytes      = 2
+	protobufStartGroup = 3
+	protobufEndGroup   = 4
+	protobufFixed32    = 5
+)
+
+// Binary decoder, first error stops decoding
+type protobufReader struct {
+	schema *protobufSchema
+	data   []byte
+	err    error
+}
+
+func (r *protobufReader) message(m *protobufMessage) common.MapStr {
+	fields := common.MapStr{}
+	for len(r.data) > 0 && r.err == nil {
+		tag := r.varint()
+		number, wire := int32(tag>>3), int(tag&7)
+		f, exists := m.fields[number]
+		if !exists {
+			r.skip(wire) // unknown field
+			continue
+		}
+
+		name := protobufJSONName(f)
+		if f.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+			fields[name] = r.value(f, wire)
+			continue
+		}
+
+		if entry, ok := r.mapEntry(f); ok {
+			values, _ := fields[name].(common.MapStr)
+			if values == nil {
+				values = common.MapStr{}
+				fields[name] = values
+			}
+			key, value := r.entry(entry, wire)
+			values[key] = value
+			continue
+		}
+
+		items, _ := fields[name].([]interface{})
+		expected := protobufWireType(f.GetType())
+		if wire == protobufBytes && expected != protobufBytes {
+			// packed repeated scalars
+			packed := &protobufReader{schema: r.schema, data: r.bytes()}
+			for len(packed.data) > 0 && packed.err == nil {
+				items = append(items, packed.value(f, expected))
+			}
+			r.fail(packed.err)
+		} else {
+			items = append(items, r.value(f, wire))
+		}
+		fields[name] = items
+	}
+	return fields
+}
+
+func (r *protobufReader) value(f *descriptor.FieldDescriptorProto, wire int) interface{} {
+	if expected := protobufWireType(f.GetType()); wire != expected {
+		r.fail(fmt.Errorf("protobuf field %s has wire type %d, expected %d", f.GetName(), wire, expected))
+		return nil
+	}
+
+	switch f.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return protobufFloat(math.Float64frombits(r.fixed64()))
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		v := math.Float32frombits(r.fixed32())
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return protobufFloat(float64(v))
+		}
+		return v
+	case descriptor.FieldDescriptorProto_TYPE_INT64:
+		return r.int64(int64(r.varint()))
+	case descriptor.FieldDescriptorProto_TYPE_SINT64:
+		return r.int64(protobufZigzag(r.varint()))
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return r.int64(int64(r.fixed64()))
+	case descriptor.FieldDescriptorProto_TYPE_UINT64:
+		return r.uint64(r.varint())
+	case descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return r.uint64(r.fixed64())
+	case descriptor.FieldDescriptorProto_TYPE_INT32:
+		return int32(r.varint())
+	case descriptor.FieldDescriptorProto_TYPE_SINT32:
+		return int32(protobufZigzag(r.varint()))
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(r.fixed32())
+	case descriptor.FieldDescriptorProto_TYPE_UINT32:
+		return uint32(r.varint())
+	case descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return r.fixed32()
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return r.varint() != 0
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return string(r.bytes())
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return base64.StdEncoding.EncodeToString(r.bytes())
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		v := int32(r.varint())
+		if name, exists := r.schema.enums[strings.TrimPrefix(f.GetTypeName(), ".")][v]; exists {
+			return name
+		}
+		return v // unknown values are kept as numbers
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		m, err := r.schema.Message(f.GetTypeName())
+		if err != nil {
+			r.fail(err)
+			return nil
+		}
+		nested := &protobufReader{schema: r.schema, data: r.bytes()}
+		v := nested.wellKnown(m)
+		r.fail(nested.err)
+		return v
+	default:
+		r.fail(fmt.Errorf("unsupported protobuf type %s of field %s", f.GetType(), f.GetName()))
+	}
+	return nil
+}
+
+// Map entry message of map field
+func (r *protobufReader) mapEntry(f *descriptor.FieldDescriptorProto) (*protobufMessage, bool) {
+	if f.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+		return nil, false
+	}
+	m, err := r.schema.Message(f.GetTypeName())
+	if err != nil || !m.mapEntry {
+		return nil, false
+	}
+	return m, true
+}
+
+// Map entry key, as string, and value, missing ones take default values
+func (r *protobufReader) entry(m *protobufMessage, wire int) (string, interface{}) {
+	if wire != protobufBytes {
+		r.fail(fmt.Errorf("protobuf map entry %s has wire type %d", m.name, wire))
+		return "", nil
+	}
+	nested := &protobufReader{schema: r.schema, data: r.bytes()}
+	fields := nested.message(m)
+	r.fail(nested.err)
+
+	key, exists := fields[protobufJSONName(m.fields[1])]
+	if !exists {
+		key = nested.zero(m.fields[1])
+	}
+	value, exists := fields[protobufJSONName(m.fields[2])]
+	if !exists {
+		value = nested.zero(m.fields[2])
+	}
+	return fmt.Sprint(key), value
+}
+
+// Well-known types mapping, other messages are decoded as common.MapStr
+func (r *protobufReader) wellKnown(m *protobufMessage) interface{} {
+	switch m.name {
+	case "google.protobuf.Timestamp":
+		seconds, nanos := r.secondsNanos()
+		return common.Time(time.Unix(seconds, int64(nanos)).UTC())
+	case "google.protobuf.Duration":
+		return protobufDuration(r.secondsNanos())
+	}
+
+	fields := r.message(m)
+	switch m.name {
+	case "google.protobuf.Struct":
+		if values, ok := fields["fields"]; ok {
+			return values
+		}
+		return common.MapStr{}
+	case "google.protobuf.ListValue":
+		if values, ok := fields["values"]; ok {
+			return values
+		}
+		return []interface{}{}
+	case "google.protobuf.Value":
+		for name, v := range fields {
+			if name == "nullValue" {
+				return nil
+			}
+			return v // oneof, single value is set
+		}
+		return nil
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue",
+		"google.protobuf.BytesValue":
+		if v, ok := fields["value"]; ok {
+			return v
+		}
+		if f, ok := m.fields[1]; ok {
+			return r.zero(f)
+		}
+		return nil
+	}
+	return fields
+}
+
+// Timestamp and Duration seconds and nanos
+func (r *protobufReader) secondsNanos() (int64, int32) {
+	var seconds int64
+	var nanos int32
+	for len(r.data) > 0 && r.err == nil {
+		tag := r.varint()
+		switch number, wire := tag>>3, int(tag&7); {
+		case number == 1 && wire == protobufVarint:
+			seconds = int64(r.varint())
+		case number == 2 && wire == protobufVarint:
+			nanos = int32(r.varint())
+		default:
+			r.skip(wire)
+		}
+	}
+	return seconds, nanos
+}
+
+func (r *protobufReader) int64(v int64) interface{} {
+	if r.schema.int64AsString {
+		return strconv.FormatInt(v, 10)
+	}
+	return v
+}
+
+func (r *protobufReader) uint64(v uint64) interface{} {
+	if r.schema.int64AsString {
+		return strconv.FormatUint(v, 10)
+	}
+	return v
+}
+
+// Skips value of unknown field
+func (r *protobufReader) skip(wire int) {
+	switch wire {
+	case protobufVarint:
+		r.varint()
+	case protobufFixed64:
+		r.next(8)
+	case protobufBytes:
+		r.bytes()
+	case protobufFixed32:
+		r.next(4)
+	default:
+		r.fail(fmt.Errorf("unsupported protobuf wire type %d", wire))
+	}
+}
+
+func (r *protobufReader) varint() uint64 {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b := r.next(1)
+		if b == nil {
+			return 0
+		}
+		v |= uint64(b[0]&0x7f) << shift
+		if b[0]&0x80 == 0 {
+			return v
+		}
+	}
+	r.fail(errors.New("protobuf varint overflow"))
+	return 0
+}
+
+func (r *protobufReader) fixed32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *protobufReader) fixed64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *protobufReader) bytes() []byte {
+	n := r.varint()
+	if n > uint64(len(r.data)) {
+		r.fail(errProtobufShortBuffer)
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *protobufReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.fail(errProtobufShortBuffer)
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *protobufReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func protobufWireType(t descriptor.FieldDescriptorProto_Type) int {
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE,
+		descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return protobufFixed64
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT,
+		descriptor.FieldDescriptorProto_TYPE_FIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return protobufFixed32
+	case descriptor.FieldDescriptorProto_TYPE_STRING,
+		descriptor.FieldDescriptorProto_TYPE_BYTES,
+		descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		return protobufBytes
+	case descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return protobufStartGroup
+	default:
+		return protobufVarint
+	}
+}
+
+// Whether field is singular google.protobuf.Timestamp
+func protobufIsTimestamp(f *descriptor.FieldDescriptorProto) bool {
+	return f.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE &&
+		f.GetTypeName() == ".google.protobuf.Timestamp" &&
+		f.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED
+}
+
+// Whether message has google.protobuf.Timestamp field of given JSON name
+func (m *protobufMessage) HasTimestamp(name string) bool {
+	for _, f := range m.fields {
+		if protobufJSONName(f) == name && protobufIsTimestamp(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// Field JSON name, as set by protoc or derived from field name
+func protobufJSONName(f *descriptor.FieldDescriptorProto) string {
+	if name := f.GetJsonName(); name != "" {
+		return name
+	}
+
+	var b strings.Builder
+	upper := false
+	for _, c := range f.GetName() {
+		switch {
+		case c == '_':
+			upper = true
+		case upper && c >= 'a' && c <= 'z':
+			b.WriteRune(c - 'a' + 'A')
+			upper = false
+		default:
+			b.WriteRune(c)
+			upper = false
+		}
+	}
+	return b.String()
+}
+
+// Default value of missing map entry and wrapper value fields, zero bytes
+// decode as zero value of any type
+func (r *protobufReader) zero(f *descriptor.FieldDescriptorProto) interface{} {
+	zero := &protobufReader{schema: r.schema, data: make([]byte, 8)}
+	return zero.value(f, protobufWireType(f.GetType()))
+}
+
+func protobufZigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// Special float values are strings in JSON mapping
+func protobufFloat(v float64) interface{} {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	return v
+}
+
+// Duration in seconds with 0, 3, 6 or 9 fractional digits, e.g. "1.500s"
+func protobufDuration(seconds int64, nanos int32) string {
+	sign := ""
+	if seconds < 0 || nanos < 0 {
+		sign = "-"
+		if seconds < 0 {
+			seconds = -seconds
+		}
+		if nanos < 0 {
+			nanos = -nanos
+		}
+	}
+
+	s := fmt.Sprintf("%s%d", sign, seconds)
+	switch {
+	case nanos == 0:
+	case nanos%1000000 == 0:
+		s += fmt.Sprintf(".%03d", nanos/1000000)
+	case nanos%1000 == 0:
+		s += fmt.Sprintf(".%06d", nanos/1000)
+	default:
+		s += fmt.Sprintf(".%09d", nanos)
+	}
+	return s + "s"
+}
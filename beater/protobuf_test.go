@@ -0,0 +1,425 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Minimal protobuf binary encoder for test data
+type testProtobufWriter struct {
+	buf []byte
+}
+
+func (w *testProtobufWriter) varint(v uint64) *testProtobufWriter {
+	for v >= 0x80 {
+		w.buf = append(w.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	w.buf = append(w.buf, byte(v))
+	return w
+}
+
+func (w *testProtobufWriter) tag(number, wire int) *testProtobufWriter {
+	return w.varint(uint64(number<<3 | wire))
+}
+
+func (w *testProtobufWriter) bytes(number int, b []byte) *testProtobufWriter {
+	w.tag(number, protobufBytes).varint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+	return w
+}
+
+func (w *testProtobufWriter) double(number int, f float64) *testProtobufWriter {
+	w.tag(number, protobufFixed64)
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+	w.buf = append(w.buf, b...)
+	return w
+}
+
+func testProtobufField(name string, number int32, typ descriptor.FieldDescriptorProto_Type, typeName string) *descriptor.FieldDescriptorProto {
+	f := &descriptor.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Label:  descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:   typ.Enum(),
+	}
+	if typeName != "" {
+		f.TypeName = proto.String(typeName)
+	}
+	return f
+}
+
+func testProtobufRepeated(f *descriptor.FieldDescriptorProto) *descriptor.FieldDescriptorProto {
+	f.Label = descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	return f
+}
+
+// Descriptor set as compiled by protoc for:
+//
+//	package com.example;
+//	enum Status { NEW = 0; PAID = 1; }
+//	message Order {
+//	  message Customer { string name = 1; bool vip = 2; }
+//	  int64 id = 1;
+//	  google.protobuf.Timestamp created_at = 2;
+//	  Customer customer = 3;
+//	  Status status = 4;
+//	  repeated string items = 5;
+//	  map<string, double> attributes = 6;
+//	  repeated int32 quantities = 7;
+//	  bytes checksum = 8;
+//	  google.protobuf.Duration ttl = 9;
+//	  google.protobuf.StringValue note = 10;
+//	  uint64 total = 11;
+//	}
+func newTestProtobufDescriptorSet() *descriptor.FileDescriptorSet {
+	secondsNanos := []*descriptor.FieldDescriptorProto{
+		testProtobufField("seconds", 1, descriptor.FieldDescriptorProto_TYPE_INT64, ""),
+		testProtobufField("nanos", 2, descriptor.FieldDescriptorProto_TYPE_INT32, ""),
+	}
+
+	return &descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{
+		{
+			Name:    proto.String("google/protobuf/well_known.proto"),
+			Package: proto.String("google.protobuf"),
+			MessageType: []*descriptor.DescriptorProto{
+				{Name: proto.String("Timestamp"), Field: secondsNanos},
+				{Name: proto.String("Duration"), Field: secondsNanos},
+				{Name: proto.String("StringValue"), Field: []*descriptor.FieldDescriptorProto{
+					testProtobufField("value", 1, descriptor.FieldDescriptorProto_TYPE_STRING, ""),
+				}},
+			},
+		},
+		{
+			Name:    proto.String("order.proto"),
+			Package: proto.String("com.example"),
+			EnumType: []*descriptor.EnumDescriptorProto{{
+				Name: proto.String("Status"),
+				Value: []*descriptor.EnumValueDescriptorProto{
+					{Name: proto.String("NEW"), Number: proto.Int32(0)},
+					{Name: proto.String("PAID"), Number: proto.Int32(1)},
+				},
+			}},
+			MessageType: []*descriptor.DescriptorProto{{
+				Name: proto.String("Order"),
+				Field: []*descriptor.FieldDescriptorProto{
+					testProtobufField("id", 1, descriptor.FieldDescriptorProto_TYPE_INT64, ""),
+					testProtobufField("created_at", 2, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp"),
+					testProtobufField("customer", 3, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".com.example.Order.Customer"),
+					testProtobufField("status", 4, descriptor.FieldDescriptorProto_TYPE_ENUM, ".com.example.Status"),
+					testProtobufRepeated(testProtobufField("items", 5, descriptor.FieldDescriptorProto_TYPE_STRING, "")),
+					testProtobufRepeated(testProtobufField("attributes", 6, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".com.example.Order.AttributesEntry")),
+					testProtobufRepeated(testProtobufField("quantities", 7, descriptor.FieldDescriptorProto_TYPE_INT32, "")),
+					testProtobufField("checksum", 8, descriptor.FieldDescriptorProto_TYPE_BYTES, ""),
+					testProtobufField("ttl", 9, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Duration"),
+					testProtobufField("note", 10, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.StringValue"),
+					testProtobufField("total", 11, descriptor.FieldDescriptorProto_TYPE_UINT64, ""),
+				},
+				NestedType: []*descriptor.DescriptorProto{
+					{
+						Name: proto.String("Customer"),
+						Field: []*descriptor.FieldDescriptorProto{
+							testProtobufField("name", 1, descriptor.FieldDescriptorProto_TYPE_STRING, ""),
+							testProtobufField("vip", 2, descriptor.FieldDescriptorProto_TYPE_BOOL, ""),
+						},
+					},
+					{
+						Name: proto.String("AttributesEntry"),
+						Field: []*descriptor.FieldDescriptorProto{
+							testProtobufField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING, ""),
+							testProtobufField("value", 2, descriptor.FieldDescriptorProto_TYPE_DOUBLE, ""),
+						},
+						Options: &descriptor.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			}},
+		},
+	}}
+}
+
+func newTestProtobufCustomer() []byte {
+	w := &testProtobufWriter{}
+	w.bytes(1, []byte("acme"))
+	w.tag(2, protobufVarint).varint(1)
+	return w.buf
+}
+
+func newTestProtobufOrder() []byte {
+	w := &testProtobufWriter{}
+	w.tag(1, protobufVarint).varint(42)
+	w.bytes(2, (&testProtobufWriter{}).tag(1, protobufVarint).varint(1556298970).tag(2, protobufVarint).varint(945000000).buf)
+	w.bytes(3, newTestProtobufCustomer())
+	w.tag(4, protobufVarint).varint(1)
+	w.bytes(5, []byte("book")).bytes(5, []byte("pen"))
+	w.bytes(6, (&testProtobufWriter{}).bytes(1, []byte("weight")).double(2, 1.5).buf)
+	w.bytes(6, (&testProtobufWriter{}).bytes(1, []byte("empty")).buf)
+	w.bytes(7, []byte{1, 2}) // packed
+	w.tag(7, protobufVarint).varint(3)
+	w.tag(99, protobufVarint).varint(7) // unknown field
+	w.bytes(8, []byte{0xca, 0xfe})
+	w.bytes(9, (&testProtobufWriter{}).tag(1, protobufVarint).varint(1).tag(2, protobufVarint).varint(500000000).buf)
+	w.bytes(10, (&testProtobufWriter{}).bytes(1, []byte("gift")).buf)
+	w.tag(11, protobufVarint).varint(math.MaxUint64)
+	return w.buf
+}
+
+func TestProtobufDecode(t *testing.T) {
+	schema := newProtobufSchema(newTestProtobufDescriptorSet(), true)
+	m, err := schema.Message("com.example.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := schema.Decode(m, newTestProtobufOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := common.MapStr{
+		"id":         "42",
+		"createdAt":  common.Time(time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC)),
+		"customer":   common.MapStr{"name": "acme", "vip": true},
+		"status":     "PAID",
+		"items":      []interface{}{"book", "pen"},
+		"attributes": common.MapStr{"weight": 1.5, "empty": float64(0)},
+		"quantities": []interface{}{int32(1), int32(2), int32(3)},
+		"checksum":   "yv4=",
+		"ttl":        "1.500s",
+		"note":       "gift",
+		"total":      "18446744073709551615",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v", expected)
+		t.Errorf("   found %v", fields)
+	}
+}
+
+func TestProtobufDecodeInt64AsNumber(t *testing.T) {
+	schema := newProtobufSchema(newTestProtobufDescriptorSet(), false)
+	m, err := schema.Message(".com.example.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := schema.Decode(m, newTestProtobufOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["id"] != int64(42) || fields["total"] != uint64(math.MaxUint64) {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+}
+
+func TestProtobufDecodeInvalid(t *testing.T) {
+	schema := newProtobufSchema(newTestProtobufDescriptorSet(), true)
+	m, err := schema.Message("com.example.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestProtobufOrder()
+	for _, data := range [][]byte{
+		order[:len(order)-1],
+		{0x1a, 0x05, 0x0a}, // truncated nested message
+		{0x0a, 0x01, 0x00}, // length-delimited id
+		{0xff, 0xff, 0xff}, // truncated varint
+	} {
+		if _, err := schema.Decode(m, data); err == nil {
+			t.Errorf("Error expected for %v", data)
+		}
+	}
+
+	if _, err := schema.Message("com.example.Unknown"); err == nil {
+		t.Error("Error expected for unknown message type")
+	}
+}
+
+func writeTestProtobufDescriptorSet(t *testing.T, dir string) string {
+	data, err := proto.Marshal(newTestProtobufDescriptorSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "order.desc")
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestProtobufDecoder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkabeat-protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := newProtobufDecoder(config.ProtobufConfig{
+		DescriptorSet: writeTestProtobufDescriptorSet(t, dir),
+		MessageType:   "com.example.Order",
+	}, "createdAt", "", common.TsLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := decodeSingleEvent(t, d, &sarama.ConsumerMessage{Value: newTestProtobufOrder()})
+	ts := time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC)
+	if !e.Timestamp.Equal(ts) {
+		t.Errorf("Expected %v", ts)
+		t.Errorf("   found %v", e.Timestamp)
+	}
+	if _, exists := e.Fields["createdAt"]; exists {
+		t.Error("Timestamp field must be removed from fields")
+	}
+
+	_, err = d.Decode(&sarama.ConsumerMessage{Value: []byte{0xff}})
+	if _, ok := err.(*decodeError); !ok {
+		t.Errorf("Decode error expected, found %v", err)
+	}
+}
+
+func TestProtobufDecoderTimestampField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkabeat-protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := writeTestProtobufDescriptorSet(t, dir)
+
+	// first google.protobuf.Timestamp field, or the named one, is kept
+	ts := time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC)
+	for _, field := range []string{"", "createdAt"} {
+		d, err := newProtobufDecoder(config.ProtobufConfig{
+			DescriptorSet:  filename,
+			MessageType:    "com.example.Order",
+			TimestampField: field,
+		}, "@timestamp", "", common.TsLayout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.timeNowFn = func() time.Time { return testNowValue }
+
+		e := decodeSingleEvent(t, d, &sarama.ConsumerMessage{Value: newTestProtobufOrder()})
+		if !e.Timestamp.Equal(ts) {
+			t.Errorf("%s: expected %v, found %v", field, ts, e.Timestamp)
+		}
+		if _, exists := e.Fields["createdAt"]; !exists {
+			t.Errorf("%s: timestamp field expected to be kept", field)
+		}
+
+		// message without timestamp
+		e = decodeSingleEvent(t, d, &sarama.ConsumerMessage{
+			Value: (&testProtobufWriter{}).tag(1, protobufVarint).varint(42).buf,
+		})
+		if !e.Timestamp.Equal(testNowValue) {
+			t.Errorf("%s: expected %v, found %v", field, testNowValue, e.Timestamp)
+		}
+	}
+
+	for _, field := range []string{"ttl", "missing"} {
+		if _, err := newProtobufDecoder(config.ProtobufConfig{
+			DescriptorSet:  filename,
+			MessageType:    "com.example.Order",
+			TimestampField: field,
+		}, "@timestamp", "", common.TsLayout); err == nil {
+			t.Errorf("Error expected for timestamp_field %s", field)
+		}
+	}
+}
+
+func TestProtobufDecoderConfluentWireFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkabeat-protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := newProtobufDecoder(config.ProtobufConfig{
+		DescriptorSet:       writeTestProtobufDescriptorSet(t, dir),
+		MessageType:         "com.example.Order",
+		ConfluentWireFormat: true,
+		Int64AsString:       true,
+	}, "@timestamp", "", common.TsLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first message in file
+	e := decodeSingleEvent(t, d, &sarama.ConsumerMessage{
+		Value: newTestConfluentValue(3, append([]byte{0}, newTestProtobufOrder()...)),
+	})
+	if e.Fields["id"] != "42" {
+		t.Errorf("Unexpected fields %v", e.Fields)
+	}
+
+	// message indexes [0, 0] select Order.Customer
+	e = decodeSingleEvent(t, d, &sarama.ConsumerMessage{
+		Value: newTestConfluentValue(3, append([]byte{4, 0, 0}, newTestProtobufCustomer()...)),
+	})
+	if e.Fields["name"] != "acme" {
+		t.Errorf("Unexpected fields %v", e.Fields)
+	}
+
+	for name, value := range map[string][]byte{
+		"magic byte":         {1, 0, 0, 0, 3, 0},
+		"missing index":      newTestConfluentValue(3, nil),
+		"index out of range": newTestConfluentValue(3, []byte{2, 2}),
+	} {
+		events, err := d.Decode(&sarama.ConsumerMessage{Value: value})
+		if len(events) != 0 {
+			t.Errorf("%s: no events expected, found %v", name, events)
+		}
+		if _, ok := err.(*decodeError); !ok {
+			t.Errorf("%s: decode error expected, found %v", name, err)
+		}
+	}
+}
+
+func TestProtobufCodecConfig(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		{"codec": "protobuf"},
+		{"codec": "protobuf", "protobuf.descriptor_set": "missing.desc", "protobuf.message_type": "a.B"},
+	} {
+		cfg, err := common.NewConfigFrom(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("Error expected for %v", settings)
+		}
+	}
+}
+
+func TestProtobufDuration(t *testing.T) {
+	cases := []struct {
+		seconds  int64
+		nanos    int32
+		expected string
+	}{
+		{1, 0, "1s"},
+		{1, 500000000, "1.500s"},
+		{0, 1000, "0.000001s"},
+		{-3, -1, "-3.000000001s"},
+	}
+
+	for _, c := range cases {
+		if s := protobufDuration(c.seconds, c.nanos); s != c.expected {
+			t.Errorf("Expected %s, found %s", c.expected, s)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package beater
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common/file"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Registry file entry, offset is the next offset to consume
+type registryState struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Local offset registry
+//
+// Offsets of acknowledged messages are kept in memory and written to the
+// registry file every registry_flush and on close, or on every commit if
+// registry_flush is 0. The file is written to a temporary file first, synced
+// and renamed over the registry file, so it is never left partially written.
+type registrar struct {
+	path   string
+	logger *logp.Logger
+
+	mu         sync.Mutex
+	offsets    map[topicPartition]int64
+	dirty      bool
+	syncWrites bool // write on every commit
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Loads registry file, missing file is an empty registry
+func newRegistrar(path string, flush time.Duration) (*registrar, error) {
+	r := &registrar{
+		path:       path,
+		logger:     logp.NewLogger("registrar"),
+		offsets:    map[topicPartition]int64{},
+		done:       make(chan struct{}),
+		syncWrites: flush <= 0,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	if flush > 0 {
+		r.wg.Add(1)
+		go r.flushLoop(flush)
+	}
+	return r, nil
+}
+
+func (r *registrar) load() error {
+	f, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		r.logger.Infof("registry file %s not found, starting with empty registry", r.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var states []registryState
+	if err := json.NewDecoder(f).Decode(&states); err != nil {
+		return err
+	}
+	for _, s := range states {
+		r.offsets[topicPartition{s.Topic, s.Partition}] = s.Offset
+	}
+	r.logger.Infof("loaded %d partition offsets from registry file %s", len(states), r.path)
+	return nil
+}
+
+// Next offset to consume from partition, false if partition is unknown
+func (r *registrar) Offset(topic string, partition int32) (int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	offset, exists := r.offsets[topicPartition{topic, partition}]
+	return offset, exists
+}
+
+// Sets next offset to consume from partition, written on next flush
+func (r *registrar) Mark(topic string, partition int32, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.offsets[topicPartition{topic, partition}] = offset
+	r.dirty = true
+	if !r.syncWrites {
+		return
+	}
+	if err := r.write(); err != nil {
+		r.logger.Errorf("failed to write registry file: %v", err)
+		return
+	}
+	r.dirty = false
+}
+
+// Writes registry file if offsets changed since last write
+func (r *registrar) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.dirty {
+		return nil
+	}
+	if err := r.write(); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+func (r *registrar) write() error {
+	states := make([]registryState, 0, len(r.offsets))
+	for tp, offset := range r.offsets {
+		states = append(states, registryState{tp.topic, tp.partition, offset})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Topic != states[j].Topic {
+			return states[i].Topic < states[j].Topic
+		}
+		return states[i].Partition < states[j].Partition
+	})
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0750); err != nil {
+		return err
+	}
+	tempfile := r.path + ".new"
+	f, err := os.OpenFile(tempfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(states); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return file.SafeFileRotate(r.path, tempfile)
+}
+
+func (r *registrar) flushLoop(interval time.Duration) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				r.logger.Errorf("failed to write registry file: %v", err)
+			}
+		}
+	}
+}
+
+// Stops periodic flush and writes final offsets
+func (r *registrar) Close() error {
+	close(r.done)
+	r.wg.Wait()
+	return r.Flush()
+}
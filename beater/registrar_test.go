@@ -0,0 +1,97 @@
+// +build !integration
+
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRegistryPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kafkabeat-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "data", "registry"), func() { os.RemoveAll(dir) }
+}
+
+func TestRegistrar(t *testing.T) {
+	path, cleanup := newTestRegistryPath(t)
+	defer cleanup()
+
+	r, err := newRegistrar(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := r.Offset("orders", 0); exists {
+		t.Error("Unexpected offset in empty registry")
+	}
+
+	r.Mark("orders", 3, 7)
+	r.Mark("orders", 0, 42)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Registry file must not be written before flush")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"topic":"orders","partition":0,"offset":42},{"topic":"orders","partition":3,"offset":7}]` + "\n"
+	if string(data) != expected {
+		t.Errorf("Expected %s", expected)
+		t.Errorf("   found %s", data)
+	}
+	if _, err := os.Stat(path + ".new"); !os.IsNotExist(err) {
+		t.Error("Temporary file must be renamed")
+	}
+
+	// loaded on startup
+	r, err = newRegistrar(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if offset, exists := r.Offset("orders", 3); !exists || offset != 7 {
+		t.Errorf("Expected offset 7 loaded, found %d", offset)
+	}
+}
+
+func TestRegistrarSyncWrites(t *testing.T) {
+	path, cleanup := newTestRegistryPath(t)
+	defer cleanup()
+
+	r, err := newRegistrar(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.Mark("orders", 0, 1)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[{"topic":"orders","partition":0,"offset":1}]` + "\n"; string(data) != expected {
+		t.Errorf("Expected %s, found %s", expected, data)
+	}
+}
+
+func TestRegistrarInvalid(t *testing.T) {
+	path, cleanup := newTestRegistryPath(t)
+	defer cleanup()
+
+	os.MkdirAll(filepath.Dir(path), 0750)
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRegistrar(path, time.Second); err == nil {
+		t.Error("Error expected for corrupted registry file")
+	}
+}
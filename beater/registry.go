@@ -0,0 +1,154 @@
+package beater
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Confluent wire format: magic byte, 4 byte schema ID, payload
+const confluentMagicByte = 0
+
+// Splits Confluent wire format value into schema ID and payload
+func confluentSchemaID(value []byte) (uint32, []byte, error) {
+	if len(value) < 5 {
+		return 0, nil, errors.New("value is too short for confluent wire format")
+	}
+	if value[0] != confluentMagicByte {
+		return 0, nil, fmt.Errorf("unknown magic byte: %d", value[0])
+	}
+	return binary.BigEndian.Uint32(value[1:5]), value[5:], nil
+}
+
+// Confluent Schema Registry client
+//
+// Schemas are immutable for given ID, so they are cached for the lifetime
+// of the beat. Registry failures other than unknown schema ID are retried
+// with backoff until they succeed or beat is stopped.
+type schemaRegistry struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+	done     <-chan struct{}
+	logger   *logp.Logger
+
+	mu      sync.RWMutex
+	schemas map[uint32]*avroSchema
+}
+
+// Schema is not registered or invalid, no point in retrying
+type schemaError struct {
+	id  uint32
+	err error
+}
+
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("schema id %d: %v", e.id, e.err)
+}
+
+func newSchemaRegistry(cfg config.SchemaRegistryConfig, done <-chan struct{}) (*schemaRegistry, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("error in configuration, schema_registry.url is required")
+	}
+
+	tlsConfig, err := tlscommon.LoadTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.BuildModuleConfig("")
+	}
+
+	return &schemaRegistry{
+		url:      strings.TrimRight(cfg.URL, "/"),
+		username: cfg.Username,
+		password: cfg.Password,
+		client:   &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		done:     done,
+		logger:   logp.NewLogger("schema_registry"),
+		schemas:  map[uint32]*avroSchema{},
+	}, nil
+}
+
+// Schema by ID, from cache or schema registry
+func (r *schemaRegistry) Schema(id uint32) (*avroSchema, error) {
+	r.mu.RLock()
+	schema, exists := r.schemas[id]
+	r.mu.RUnlock()
+	if exists {
+		return schema, nil
+	}
+
+	backoff := common.NewBackoff(r.done, time.Second, time.Minute)
+	for {
+		schema, err := r.fetch(id)
+		if err == nil {
+			r.mu.Lock()
+			r.schemas[id] = schema
+			r.mu.Unlock()
+			return schema, nil
+		}
+		if _, ok := err.(*schemaError); ok {
+			return nil, err
+		}
+
+		r.logger.Errorf("failed to fetch schema id %d: %v", id, err)
+		if !backoff.Wait() {
+			return nil, err
+		}
+	}
+}
+
+func (r *schemaRegistry) fetch(id uint32) (*avroSchema, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/schemas/ids/%d", r.url, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &schemaError{id, errors.New("not found in schema registry")}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("schema registry responded with %s", resp.Status)
+	}
+
+	var body struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid schema registry response: %v", err)
+	}
+	if body.SchemaType != "" && body.SchemaType != "AVRO" {
+		return nil, &schemaError{id, fmt.Errorf("unsupported schema type %s", body.SchemaType)}
+	}
+
+	schema, err := parseAvroSchema(body.Schema)
+	if err != nil {
+		return nil, &schemaError{id, err}
+	}
+	return schema, nil
+}
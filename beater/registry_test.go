@@ -0,0 +1,230 @@
+// +build !integration
+
+package beater
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
+)
+
+// Schema Registry stand-in serving given schemas by ID
+type testRegistry struct {
+	schemas  map[uint32]string
+	username string
+	password string
+	requests int32
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&r.requests, 1)
+
+	if r.username != "" {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != r.username || password != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var id uint32
+	if _, err := fmt.Sscanf(req.URL.Path, "/schemas/ids/%d", &id); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	schema, exists := r.schemas[id]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error_code":40403,"message":"Schema not found"}`)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"schema": schema})
+}
+
+func newTestSchemaRegistry(t *testing.T, url string, cfg config.SchemaRegistryConfig) *schemaRegistry {
+	cfg.URL = url
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second
+	}
+	registry, err := newSchemaRegistry(cfg, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func newTestConfluentValue(id uint32, payload []byte) []byte {
+	value := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(value[1:], id)
+	return append(value, payload...)
+}
+
+func TestAvroDecoderWithRegistry(t *testing.T) {
+	registry := &testRegistry{schemas: map[uint32]string{7: testAvroSchema}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	d := newAvroDecoder(
+		newTestSchemaRegistry(t, server.URL, config.SchemaRegistryConfig{}),
+		"@timestamp", "", common.TsLayout,
+	)
+
+	for i := 0; i < 3; i++ {
+		e := decodeSingleEvent(t, d, &sarama.ConsumerMessage{
+			Value: newTestConfluentValue(7, newTestAvroOrder()),
+		})
+
+		ts := time.Date(2019, time.April, 26, 17, 16, 10, 945000000, time.UTC)
+		if !e.Timestamp.Equal(ts) {
+			t.Errorf("Expected %v", ts)
+			t.Errorf("   found %v", e.Timestamp)
+		}
+		if _, exists := e.Fields["@timestamp"]; exists {
+			t.Error("Timestamp field must be removed from fields")
+		}
+		if name, _ := e.Fields.GetValue("customer.name"); name != "acme" {
+			t.Errorf("Unexpected fields %v", e.Fields)
+		}
+	}
+
+	if registry.requests != 1 {
+		t.Errorf("Schema must be cached, found %d registry requests", registry.requests)
+	}
+}
+
+func TestAvroDecoderErrors(t *testing.T) {
+	server := httptest.NewServer(&testRegistry{schemas: map[uint32]string{7: testAvroSchema}})
+	defer server.Close()
+
+	d := newAvroDecoder(
+		newTestSchemaRegistry(t, server.URL, config.SchemaRegistryConfig{}),
+		"@timestamp", "", common.TsLayout,
+	)
+
+	for name, value := range map[string][]byte{
+		"magic byte":    append([]byte{1}, newTestConfluentValue(7, newTestAvroOrder())[1:]...),
+		"short value":   {0, 0, 0},
+		"unknown id":    newTestConfluentValue(8, newTestAvroOrder()),
+		"invalid datum": newTestConfluentValue(7, []byte{0x54}),
+	} {
+		events, err := d.Decode(&sarama.ConsumerMessage{Value: value})
+		if len(events) != 0 {
+			t.Errorf("%s: no events expected, found %v", name, events)
+		}
+		if _, ok := err.(*decodeError); !ok {
+			t.Errorf("%s: decode error expected, found %v", name, err)
+		}
+	}
+}
+
+func TestSchemaRegistryBasicAuth(t *testing.T) {
+	registry := &testRegistry{
+		schemas:  map[uint32]string{1: `"string"`},
+		username: "kafkabeat",
+		password: "secret",
+	}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	r := newTestSchemaRegistry(t, server.URL, config.SchemaRegistryConfig{
+		Username: "kafkabeat",
+		Password: "secret",
+	})
+	if _, err := r.Schema(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaRegistryUnavailable(t *testing.T) {
+	registry := &testRegistry{schemas: map[uint32]string{1: `"string"`}, username: "kafkabeat"}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	done := make(chan struct{})
+	r, err := newSchemaRegistry(config.SchemaRegistryConfig{URL: server.URL, Timeout: time.Second}, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unauthorized is retried until beat is stopped
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+	_, err = r.Schema(1)
+	if err == nil {
+		t.Fatal("Error expected")
+	}
+	if _, ok := err.(*schemaError); ok {
+		t.Errorf("Registry failure must not be reported as schema error: %v", err)
+	}
+
+	d := newAvroDecoder(r, "@timestamp", "", common.TsLayout)
+	_, err = d.Decode(&sarama.ConsumerMessage{Value: newTestConfluentValue(1, []byte{0})})
+	if _, ok := err.(*decodeError); err == nil || ok {
+		t.Errorf("Expected processing error, found %v", err)
+	}
+}
+
+func TestSchemaRegistryTLS(t *testing.T) {
+	server := httptest.NewTLSServer(&testRegistry{schemas: map[uint32]string{1: `"string"`}})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kafkabeat-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestSchemaRegistry(t, server.URL, config.SchemaRegistryConfig{
+		TLS: &tlscommon.Config{CAs: []string{ca}},
+	})
+	if _, err := r.Schema(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown authority is not trusted
+	done := make(chan struct{})
+	close(done)
+	r, err = newSchemaRegistry(config.SchemaRegistryConfig{URL: server.URL, Timeout: time.Second}, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Schema(1); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Certificate error expected, found %v", err)
+	}
+}
+
+func TestAvroCodecRequiresRegistry(t *testing.T) {
+	cfg, err := common.NewConfigFrom(map[string]interface{}{"codec": "avro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(nil, cfg); err == nil {
+		t.Error("Error expected for avro codec without schema_registry.url")
+	}
+
+	newTestBeater(t, map[string]interface{}{
+		"codec":               "avro",
+		"schema_registry.url": "http://localhost:8081",
+	})
+}
@@ -0,0 +1,109 @@
+package beater
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Maximum dead-letter file line size
+const replayMaxLineSize = 64 * 1024 * 1024
+
+// Dead-letter file replay
+//
+// Re-injects messages from dead-letter file through the configured codec and
+// publishes decoded events to the configured output. Exits once all events
+// are acknowledged, or shutdown_timeout expires.
+type replayer struct {
+	bt       *Kafkabeat
+	filename string
+	logger   *logp.Logger
+}
+
+// Creates replay beater for given dead-letter file
+func NewReplay(filename string) beat.Creator {
+	return func(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+		bt, err := New(b, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &replayer{
+			bt:       bt.(*Kafkabeat),
+			filename: filename,
+			logger:   logp.NewLogger("replay"),
+		}, nil
+	}
+}
+
+func (r *replayer) Run(b *beat.Beat) error {
+	f, err := os.Open(r.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := r.bt.connect(b.Publisher, nil); err != nil {
+		return err
+	}
+
+	r.logger.Infof("replaying dead-letter file %s", r.filename)
+	messages, failed, err := r.replay(f)
+	r.bt.closePipeline() // waits for pending events to be acknowledged
+	if err != nil {
+		return err
+	}
+
+	r.logger.Infof("replayed %d messages, %d failed to decode", messages, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d messages failed to decode", failed)
+	}
+	return nil
+}
+
+// Returns number of replayed and failed messages
+func (r *replayer) replay(in io.Reader) (int, int, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, replayMaxLineSize)
+
+	messages, failed := 0, 0
+	for line := 1; scanner.Scan(); line++ {
+		select {
+		case <-r.bt.done:
+			return messages, failed, nil
+		default:
+		}
+
+		record := deadLetterRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return messages, failed, fmt.Errorf("invalid dead-letter record at line %d: %v", line, err)
+		}
+
+		msg := record.Message()
+		codec, pipeline := r.bt.route(msg.Topic)
+		events, err := codec.Decode(msg)
+		if err != nil {
+			failed++
+			r.logger.Warnf("line %d, topic: %s, partition: %d, offset: %d, %v",
+				line, msg.Topic, msg.Partition, msg.Offset, err)
+			continue
+		}
+
+		messages++
+		for i := range events {
+			r.bt.metadata.Write(&events[i], msg)
+			r.bt.documentID.Write(&events[i], msg, i, len(events))
+			pipeline.Publish(events[i])
+		}
+	}
+	return messages, failed, scanner.Err()
+}
+
+func (r *replayer) Stop() {
+	close(r.bt.done)
+}
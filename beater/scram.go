@@ -0,0 +1,48 @@
+package beater
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+// SASL/SCRAM client conversation, sarama leaves SCRAM implementation to
+// the application
+type scramClient struct {
+	hashGen scram.HashGeneratorFcn
+	nonceFn scram.NonceGeneratorFcn // random nonce if nil
+	conv    *scram.ClientConversation
+}
+
+// Returns sarama SCRAM client generator of SCRAM-SHA-256 or SCRAM-SHA-512
+func newSCRAMClientGenerator(mechanism sarama.SASLMechanism) func() sarama.SCRAMClient {
+	hashGen := scram.HashGeneratorFcn(sha256.New)
+	if mechanism == sarama.SASLTypeSCRAMSHA512 {
+		hashGen = sha512.New
+	}
+	return func() sarama.SCRAMClient {
+		return &scramClient{hashGen: hashGen}
+	}
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGen.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	if c.nonceFn != nil {
+		client = client.WithNonceGenerator(c.nonceFn)
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
@@ -0,0 +1,118 @@
+// +build !integration
+
+package beater
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+func testSCRAMNonce() string {
+	return "fyko+d2lbbFgONRv9qkxdawL"
+}
+
+// Server messages of SCRAM exchange for given credentials, client nonce is fixed
+func testSCRAMServerMessages(t *testing.T, hashGen scram.HashGeneratorFcn, user, password string) (string, string) {
+	client, err := hashGen.NewClient(user, password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = client.WithNonceGenerator(testSCRAMNonce)
+	credentials := client.GetStoredCredentials(scram.KeyFactors{Salt: "kafkabeat-salt", Iters: 4096})
+
+	server, err := hashGen.NewServer(func(string) (scram.StoredCredentials, error) {
+		return credentials, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = server.WithNonceGenerator(func() string { return "3rfcNHYJY1ZVvWVs7j" })
+
+	cc, sc := client.NewConversation(), server.NewConversation()
+	var serverMsgs []string
+	msg, err := cc.Step("")
+	for i := 0; i < 2 && err == nil; i++ {
+		if msg, err = sc.Step(msg); err == nil {
+			serverMsgs = append(serverMsgs, msg)
+			msg, err = cc.Step(msg)
+		}
+	}
+	if err != nil || !cc.Valid() {
+		t.Fatalf("SCRAM exchange failed: %v", err)
+	}
+	return serverMsgs[0], serverMsgs[1]
+}
+
+func newTestSCRAMBroker(t *testing.T, mechanism string, hashGen scram.HashGeneratorFcn) *sarama.MockBroker {
+	serverFirst, serverFinal := testSCRAMServerMessages(t, hashGen, "kafkabeat", "secret")
+
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"SaslHandshakeRequest": sarama.NewMockSaslHandshakeResponse(t).
+			SetEnabledMechanisms([]string{mechanism}),
+		"SaslAuthenticateRequest": sarama.NewMockSequence(
+			sarama.NewMockSaslAuthenticateResponse(t).SetAuthBytes([]byte(serverFirst)),
+			sarama.NewMockSaslAuthenticateResponse(t).SetAuthBytes([]byte(serverFinal)),
+		),
+		"ApiVersionsRequest": sarama.NewMockWrapper(&sarama.ApiVersionsResponse{
+			ApiVersions: []*sarama.ApiVersionsResponseBlock{
+				{ApiKey: apiKeyFetch, MinVersion: 0, MaxVersion: 8},
+			},
+		}),
+	})
+	return broker
+}
+
+func newTestSCRAMBeater(t *testing.T, broker *sarama.MockBroker, mechanism, password string) *Kafkabeat {
+	bt := newTestBeater(t, map[string]interface{}{
+		"brokers":        []string{broker.Addr()},
+		"username":       "kafkabeat",
+		"password":       password,
+		"sasl.mechanism": mechanism,
+	})
+
+	generator := bt.kConfig.Net.SASL.SCRAMClientGeneratorFunc
+	if generator == nil {
+		t.Fatal("SCRAM client generator expected")
+	}
+	bt.kConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+		client := generator().(*scramClient)
+		client.nonceFn = testSCRAMNonce
+		return client
+	}
+	return bt
+}
+
+func TestSASLSCRAM(t *testing.T) {
+	for mechanism, hashGen := range map[string]scram.HashGeneratorFcn{
+		"SCRAM-SHA-256": sha256.New,
+		"SCRAM-SHA-512": sha512.New,
+	} {
+		broker := newTestSCRAMBroker(t, mechanism, hashGen)
+
+		bt := newTestSCRAMBeater(t, broker, mechanism, "secret")
+		if !bt.kConfig.Net.SASL.Enable || string(bt.kConfig.Net.SASL.Mechanism) != mechanism {
+			t.Errorf("Expected SASL mechanism %s, found %s", mechanism, bt.kConfig.Net.SASL.Mechanism)
+		}
+		if _, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config); err != nil {
+			t.Errorf("%s: %v", mechanism, err)
+		}
+
+		broker.Close()
+	}
+}
+
+func TestSASLSCRAMInvalidCredentials(t *testing.T) {
+	broker := newTestSCRAMBroker(t, "SCRAM-SHA-256", sha256.New)
+	defer broker.Close()
+
+	// server signature of the final message does not match
+	bt := newTestSCRAMBeater(t, broker, "SCRAM-SHA-256", "invalid")
+	if _, err := detectKafkaVersion(bt.bConfig.Brokers, &bt.kConfig.Config); err == nil {
+		t.Error("Error expected for invalid credentials")
+	}
+}
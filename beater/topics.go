@@ -0,0 +1,172 @@
+package beater
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/arkady-emelyanov/kafkabeat/config"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/processors"
+)
+
+// Topic specific settings, on top of global codec settings
+type topicSettings struct {
+	config.CodecConfig   `config:",inline"`
+	common.EventMetadata `config:",inline"`
+	Processors           processors.PluginConfig `config:"processors"`
+}
+
+// Topic given by name or pattern with own codec, fields, tags and processors,
+// events are published through own publisher pipeline client.
+type topicRoute struct {
+	pattern  *regexp.Regexp
+	codec    decoder
+	meta     common.EventMetadata
+	procs    *processors.Processors
+	pipeline beat.Client
+}
+
+// Picks topic specific settings by message topic
+//
+// Topics given by name take precedence over patterns, patterns are matched
+// in order of configuration. Topics without specific settings use global
+// codec and publisher pipeline client.
+type topicRouter struct {
+	names    map[string]*topicRoute
+	patterns []*topicRoute
+
+	mu    sync.RWMutex
+	cache map[string]*topicRoute // pattern lookups
+}
+
+func newTopicRouter(topics []config.TopicConfig, defaults config.CodecConfig, codecs *codecFactory) (*topicRouter, error) {
+	r := &topicRouter{
+		names: map[string]*topicRoute{},
+		cache: map[string]*topicRoute{},
+	}
+
+	for _, t := range topics {
+		if t.Settings == nil {
+			continue
+		}
+
+		settings := topicSettings{CodecConfig: defaults}
+		if err := t.Settings.Unpack(&settings); err != nil {
+			return nil, fmt.Errorf("error in configuration, topic %s%s: %v", t.Topic, t.Pattern, err)
+		}
+
+		route := &topicRoute{meta: settings.EventMetadata}
+		var err error
+		if route.codec, err = codecs.Create(settings.CodecConfig); err != nil {
+			return nil, fmt.Errorf("topic %s%s: %v", t.Topic, t.Pattern, err)
+		}
+		if route.procs, err = processors.New(settings.Processors); err != nil {
+			return nil, fmt.Errorf("error in configuration, topic %s%s: %v", t.Topic, t.Pattern, err)
+		}
+
+		if t.Pattern != "" {
+			if route.pattern, err = regexp.Compile(t.Pattern); err != nil {
+				return nil, fmt.Errorf("error in configuration, invalid topic pattern: %v", err)
+			}
+			r.patterns = append(r.patterns, route)
+			continue
+		}
+		if _, exists := r.names[t.Topic]; exists {
+			return nil, fmt.Errorf("error in configuration, duplicate topic: '%s'", t.Topic)
+		}
+		r.names[t.Topic] = route
+	}
+	return r, nil
+}
+
+// Route of given topic, nil if there are no topic specific settings
+func (r *topicRouter) Lookup(topic string) *topicRoute {
+	if route, exists := r.names[topic]; exists {
+		return route
+	}
+	if len(r.patterns) == 0 {
+		return nil
+	}
+
+	r.mu.RLock()
+	route, exists := r.cache[topic]
+	r.mu.RUnlock()
+	if exists {
+		return route
+	}
+
+	for _, p := range r.patterns {
+		if p.pattern.MatchString(topic) {
+			route = p
+			break
+		}
+	}
+	r.mu.Lock()
+	r.cache[topic] = route
+	r.mu.Unlock()
+	return route
+}
+
+// Connects publisher pipeline client of every route, topic fields, tags
+// and processors are applied by the client
+func (r *topicRouter) Connect(p beat.Pipeline, cfg beat.ClientConfig) error {
+	for _, route := range r.routes() {
+		c := cfg
+		c.EventMetadata = route.meta
+		c.Processor = route.procs
+
+		client, err := p.ConnectWith(c)
+		if err != nil {
+			return err
+		}
+		route.pipeline = client
+	}
+	return nil
+}
+
+// Connected publisher pipeline clients
+func (r *topicRouter) Clients() []beat.Client {
+	var clients []beat.Client
+	for _, route := range r.routes() {
+		if route.pipeline != nil {
+			clients = append(clients, route.pipeline)
+		}
+	}
+	return clients
+}
+
+func (r *topicRouter) routes() []*topicRoute {
+	routes := make([]*topicRoute, 0, len(r.names)+len(r.patterns))
+	for _, route := range r.names {
+		routes = append(routes, route)
+	}
+	return append(routes, r.patterns...)
+}
+
+// Topic names to subscribe to
+func topicNames(topics []config.TopicConfig) []string {
+	var names []string
+	for _, t := range topics {
+		if t.Topic != "" {
+			names = append(names, t.Topic)
+		}
+	}
+	return names
+}
+
+// Closes publisher pipeline clients concurrently, each waits for pending
+// events to be acknowledged up to shutdown_timeout
+func closeClients(clients []beat.Client) {
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c beat.Client) {
+			defer wg.Done()
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+}
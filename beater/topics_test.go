@@ -0,0 +1,224 @@
+// +build !integration
+
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	_ "github.com/elastic/beats/libbeat/processors/actions"
+)
+
+// Publisher pipeline handing out test clients
+type testPipeline struct {
+	configs []beat.ClientConfig
+}
+
+func (p *testPipeline) Connect() (beat.Client, error) {
+	return p.ConnectWith(beat.ClientConfig{})
+}
+
+func (p *testPipeline) ConnectWith(cfg beat.ClientConfig) (beat.Client, error) {
+	p.configs = append(p.configs, cfg)
+	return &testClient{}, nil
+}
+
+func (p *testPipeline) SetACKHandler(beat.PipelineACKHandler) error {
+	return nil
+}
+
+func newTestTopicsBeater(t *testing.T) *Kafkabeat {
+	return newTestBeater(t, map[string]interface{}{
+		"topics": []interface{}{
+			"watch",
+			map[string]interface{}{
+				"topic":  "logs",
+				"codec":  "plain",
+				"fields": map[string]interface{}{"env": "production"},
+				"tags":   []string{"logs"},
+				"processors": []interface{}{
+					map[string]interface{}{"drop_fields": map[string]interface{}{"fields": []string{"message"}}},
+				},
+			},
+			map[string]interface{}{
+				"pattern":       `^metrics\.`,
+				"timestamp_key": "time",
+			},
+		},
+	})
+}
+
+func TestTopicsConfig(t *testing.T) {
+	bt := newTestTopicsBeater(t)
+
+	names := topicNames(bt.bConfig.Topics)
+	if expected := []string{"watch", "logs"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected topics %v, found %v", expected, names)
+	}
+
+	if route := bt.topics.Lookup("watch"); route != nil {
+		t.Errorf("Topic without settings must use global settings, found %v", route)
+	}
+	if route := bt.topics.Lookup("logs"); route == nil {
+		t.Error("Expected route of logs topic")
+	} else if _, ok := route.codec.(*plainDecoder); !ok {
+		t.Errorf("Expected plain codec, found %T", route.codec)
+	}
+
+	for _, topic := range []string{"metrics.cpu", "metrics.memory"} {
+		route := bt.topics.Lookup(topic)
+		if route == nil {
+			t.Fatalf("Expected route of %s topic", topic)
+		}
+		if d, ok := route.codec.(*jsonDecoder); !ok || d.timestampKey != "time" {
+			t.Errorf("Expected json codec with topic timestamp_key, found %v", route.codec)
+		}
+	}
+	if route := bt.topics.Lookup("logs.metrics"); route != nil {
+		t.Errorf("Unexpected route for unmatched topic %v", route)
+	}
+}
+
+func TestTopicsConfigInvalid(t *testing.T) {
+	for _, topic := range []interface{}{
+		map[string]interface{}{"codec": "plain"},
+		map[string]interface{}{"topic": "logs", "pattern": "logs"},
+		map[string]interface{}{"pattern": "logs("},
+		map[string]interface{}{"topic": "logs", "codec": "xml"},
+		42,
+	} {
+		cfg, err := common.NewConfigFrom(map[string]interface{}{
+			"topics": []interface{}{topic},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("Error expected for topic %v", topic)
+		}
+	}
+}
+
+func TestTopicsConnect(t *testing.T) {
+	bt := newTestTopicsBeater(t)
+
+	pipeline := &testPipeline{}
+	if err := bt.connect(pipeline, bt.ackEvents); err != nil {
+		t.Fatal(err)
+	}
+	if len(pipeline.configs) != 3 {
+		t.Fatalf("Expected global and 2 topic clients, found %d", len(pipeline.configs))
+	}
+
+	// global client, then topics by name and patterns
+	if pipeline.configs[0].Processor != nil {
+		t.Errorf("Global client must not have processors")
+	}
+	logs := pipeline.configs[1]
+	if !reflect.DeepEqual(logs.EventMetadata.Tags, []string{"logs"}) {
+		t.Errorf("Expected topic tags, found %v", logs.EventMetadata)
+	}
+	if logs.EventMetadata.Fields["env"] != "production" {
+		t.Errorf("Expected topic fields, found %v", logs.EventMetadata)
+	}
+	if logs.Processor == nil || len(logs.Processor.All()) != 1 {
+		t.Errorf("Expected topic processors, found %v", logs.Processor)
+	}
+	if logs.ACKEvents == nil {
+		t.Error("Topic client must acknowledge events")
+	}
+}
+
+func TestTopicsWorker(t *testing.T) {
+	bt := newTestTopicsBeater(t)
+	tracker, commits := newTestOffsetTracker()
+	bt.offsets = tracker
+
+	global, logs := &testClient{}, &testClient{}
+	bt.pipeline = global
+	bt.topics.Lookup("logs").pipeline = logs
+
+	runTestWorker(bt,
+		&sarama.ConsumerMessage{Topic: "watch", Offset: 1, Value: []byte(`{"field":"value"}`)},
+		&sarama.ConsumerMessage{Topic: "logs", Offset: 1, Value: []byte(`{"field":"value"}`)},
+	)
+
+	if len(global.events) != 1 || global.events[0].Fields["field"] != "value" {
+		t.Errorf("Expected json event published by global client, found %v", global.events)
+	}
+	if len(logs.events) != 1 || logs.events[0].Fields["message"] != `{"field":"value"}` {
+		t.Errorf("Expected plain event published by topic client, found %v", logs.events)
+	}
+
+	bt.ackEvents([]interface{}{global.events[0].Private, logs.events[0].Private})
+	if len(*commits) != 2 {
+		t.Errorf("Expected offsets of both topics committed, found %v", *commits)
+	}
+}
+
+func TestTopicsPattern(t *testing.T) {
+	bt := newTestBeater(t, map[string]interface{}{
+		"topics_pattern":          `^logs\.`,
+		"topics_exclude_pattern":  `\.staging$`,
+		"topics_refresh_interval": "30s",
+	})
+	if len(bt.bConfig.Topics) != 0 {
+		t.Errorf("Default topic must not be subscribed with topics_pattern, found %v", bt.bConfig.Topics)
+	}
+	if rx := bt.kConfig.Group.Topics.Whitelist; rx == nil || !rx.MatchString("logs.nginx.production") {
+		t.Errorf("Unexpected whitelist %v", rx)
+	}
+	if rx := bt.kConfig.Group.Topics.Blacklist; rx == nil || !rx.MatchString("logs.nginx.staging") {
+		t.Errorf("Unexpected blacklist %v", rx)
+	}
+	if !bt.kConfig.Metadata.Full || bt.kConfig.Metadata.RefreshFrequency != 30*time.Second {
+		t.Errorf("Unexpected metadata settings %+v", bt.kConfig.Metadata)
+	}
+	if err := bt.kConfig.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// explicit topics are subscribed as well
+	bt = newTestBeater(t, map[string]interface{}{
+		"topics":         []string{"audit"},
+		"topics_pattern": `^logs\.`,
+	})
+	if names := topicNames(bt.bConfig.Topics); !reflect.DeepEqual(names, []string{"audit"}) {
+		t.Errorf("Expected audit topic, found %v", names)
+	}
+}
+
+func TestTopicsPatternInvalid(t *testing.T) {
+	for _, settings := range []map[string]interface{}{
+		{"topics_pattern": "logs("},
+		{"topics_pattern": "logs", "topics_exclude_pattern": "logs("},
+		{"topics_exclude_pattern": "staging"},
+		{"topics_refresh_interval": "0s"},
+	} {
+		cfg, err := common.NewConfigFrom(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(nil, cfg); err == nil {
+			t.Errorf("Error expected for %v", settings)
+		}
+	}
+}
+
+func TestAssignmentTopics(t *testing.T) {
+	a := &assignment{}
+
+	added, removed := a.Set(map[string][]int32{"logs.a": {0, 1}, "logs.b": {0}})
+	if !reflect.DeepEqual(added, []string{"logs.a", "logs.b"}) || len(removed) != 0 {
+		t.Errorf("Unexpected changes, added %v, removed %v", added, removed)
+	}
+
+	added, removed = a.Set(map[string][]int32{"logs.b": {0, 1}, "logs.c": {0}})
+	if !reflect.DeepEqual(added, []string{"logs.c"}) || !reflect.DeepEqual(removed, []string{"logs.a"}) {
+		t.Errorf("Unexpected changes, added %v, removed %v", added, removed)
+	}
+}
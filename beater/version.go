@@ -0,0 +1,100 @@
+package beater
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// Kafka protocol API keys
+const (
+	apiKeyFetch                 int16 = 1
+	apiKeyOffsetFetch           int16 = 9
+	apiKeyElectPreferredLeaders int16 = 43
+)
+
+// API versions introduced by Kafka releases, newest first, up to
+// sarama.MaxVersion. Broker supporting given API version is at least
+// of the release. Bugfix releases without protocol changes (e.g. 2.0.1)
+// can't be told apart and are detected as the preceding release.
+var kafkaVersionProbes = []struct {
+	version    sarama.KafkaVersion
+	apiKey     int16
+	apiVersion int16
+}{
+	{sarama.V2_2_0_0, apiKeyElectPreferredLeaders, 0},
+	{sarama.V2_1_0_0, apiKeyFetch, 10},
+	{sarama.V2_0_0_0, apiKeyFetch, 8},
+	{sarama.V1_1_0_0, apiKeyFetch, 7},
+	{sarama.V1_0_0_0, apiKeyFetch, 6},
+	{sarama.V0_11_0_2, apiKeyFetch, 4},
+	{sarama.V0_10_2_1, apiKeyOffsetFetch, 2},
+	{sarama.V0_10_1_1, apiKeyFetch, 3},
+}
+
+// Parses version configuration option, version must be supported by sarama
+func parseKafkaVersion(s string) (sarama.KafkaVersion, error) {
+	version, err := sarama.ParseKafkaVersion(s)
+	if err != nil {
+		return version, fmt.Errorf("error in configuration, unknown version: '%s'", s)
+	}
+
+	for _, supported := range sarama.SupportedVersions {
+		if version == supported {
+			return version, nil
+		}
+	}
+	return version, fmt.Errorf("error in configuration, unsupported version: '%s'", s)
+}
+
+// Probes brokers with ApiVersions request and returns highest
+// version supported by both broker and sarama.
+func detectKafkaVersion(brokers []string, conf *sarama.Config) (sarama.KafkaVersion, error) {
+	// ApiVersions request requires at least 0.10.0
+	probeConf := *conf
+	probeConf.Version = sarama.V0_10_0_0
+
+	var lastErr error
+	for _, addr := range brokers {
+		versions, err := fetchAPIVersions(addr, &probeConf)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return matchKafkaVersion(versions), nil
+	}
+	return sarama.KafkaVersion{}, fmt.Errorf("unable to detect kafka version, please configure version explicitly: %v", lastErr)
+}
+
+func fetchAPIVersions(addr string, conf *sarama.Config) (map[int16]int16, error) {
+	broker := sarama.NewBroker(addr)
+	if err := broker.Open(conf); err != nil {
+		return nil, err
+	}
+	defer broker.Close()
+
+	res, err := broker.ApiVersions(&sarama.ApiVersionsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if res.Err != sarama.ErrNoError {
+		return nil, res.Err
+	}
+
+	versions := map[int16]int16{}
+	for _, block := range res.ApiVersions {
+		versions[block.ApiKey] = block.MaxVersion
+	}
+	return versions, nil
+}
+
+func matchKafkaVersion(versions map[int16]int16) sarama.KafkaVersion {
+	for _, probe := range kafkaVersionProbes {
+		if max, exists := versions[probe.apiKey]; exists && max >= probe.apiVersion {
+			return probe.version
+		}
+	}
+
+	// ApiVersions request is answered, so it's at least 0.10.0
+	return sarama.V0_10_0_1
+}
@@ -0,0 +1,82 @@
+// +build !integration
+
+package beater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestParseKafkaVersion(t *testing.T) {
+	version, err := parseKafkaVersion("1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != sarama.V1_1_0_0 {
+		t.Errorf("Expected %v", sarama.V1_1_0_0)
+		t.Errorf("   found %v", version)
+	}
+
+	for _, s := range []string{"latest", "0.7.0", "9.9.9"} {
+		if _, err := parseKafkaVersion(s); err == nil {
+			t.Errorf("Error expected for version '%s'", s)
+		}
+	}
+}
+
+func TestMatchKafkaVersion(t *testing.T) {
+	cases := []struct {
+		versions map[int16]int16
+		expected sarama.KafkaVersion
+	}{
+		{map[int16]int16{apiKeyFetch: 11, apiKeyOffsetFetch: 6, apiKeyElectPreferredLeaders: 0}, sarama.V2_2_0_0},
+		{map[int16]int16{apiKeyFetch: 10, apiKeyOffsetFetch: 5}, sarama.V2_1_0_0},
+		{map[int16]int16{apiKeyFetch: 8, apiKeyOffsetFetch: 4}, sarama.V2_0_0_0},
+		{map[int16]int16{apiKeyFetch: 7, apiKeyOffsetFetch: 4}, sarama.V1_1_0_0},
+		{map[int16]int16{apiKeyFetch: 5, apiKeyOffsetFetch: 3}, sarama.V0_11_0_2},
+		{map[int16]int16{apiKeyFetch: 3, apiKeyOffsetFetch: 2}, sarama.V0_10_2_1},
+		{map[int16]int16{apiKeyFetch: 3, apiKeyOffsetFetch: 1}, sarama.V0_10_1_1},
+		{map[int16]int16{apiKeyFetch: 2}, sarama.V0_10_0_1},
+	}
+
+	for _, c := range cases {
+		if version := matchKafkaVersion(c.versions); version != c.expected {
+			t.Errorf("Expected %v for %v", c.expected, c.versions)
+			t.Errorf("   found %v", version)
+		}
+	}
+}
+
+func TestDetectKafkaVersion(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockWrapper(&sarama.ApiVersionsResponse{
+			ApiVersions: []*sarama.ApiVersionsResponseBlock{
+				{ApiKey: apiKeyFetch, MinVersion: 0, MaxVersion: 6},
+				{ApiKey: apiKeyOffsetFetch, MinVersion: 0, MaxVersion: 3},
+			},
+		}),
+	})
+
+	version, err := detectKafkaVersion([]string{broker.Addr()}, sarama.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != sarama.V1_0_0_0 {
+		t.Errorf("Expected %v", sarama.V1_0_0_0)
+		t.Errorf("   found %v", version)
+	}
+}
+
+func TestDetectKafkaVersionUnreachable(t *testing.T) {
+	conf := sarama.NewConfig()
+	conf.Net.DialTimeout = 100 * time.Millisecond
+
+	if _, err := detectKafkaVersion([]string{"127.0.0.1:1"}, conf); err == nil {
+		t.Error("Error expected for unreachable broker")
+	}
+}
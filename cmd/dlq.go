@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/arkady-emelyanov/kafkabeat/beater"
+
+	"github.com/elastic/beats/libbeat/beat"
+	cmd "github.com/elastic/beats/libbeat/cmd"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Dead-letter queue commands
+//
+// `dlq replay <file>` is the libbeat run command of a beat replaying the file,
+// so it accepts the same flags and loads the same configuration as `run`.
+func init() {
+	var args func() []string
+	dlqCmd := cmd.GenRootCmd(Name, "", func(b *beat.Beat, cfg *common.Config) (beat.Beater, error) {
+		files := args()
+		if len(files) != 1 {
+			return nil, fmt.Errorf("dlq replay requires single dead-letter file, got: %v", files)
+		}
+		return beater.NewReplay(files[0])(b, cfg)
+	})
+	args = dlqCmd.RunCmd.Flags().Args
+
+	dlqCmd.RemoveCommand(
+		dlqCmd.SetupCmd,
+		dlqCmd.VersionCmd,
+		dlqCmd.CompletionCmd,
+		dlqCmd.ExportCmd,
+		dlqCmd.TestCmd,
+		dlqCmd.KeystoreCmd,
+	)
+	dlqCmd.ResetFlags() // root command flags are inherited from RootCmd
+	dlqCmd.Use = "dlq"
+	dlqCmd.Short = "Manage dead-letter queue"
+	dlqCmd.Run = nil
+
+	dlqCmd.RunCmd.Use = "replay <file>"
+	dlqCmd.RunCmd.Short = "Replay dead-letter file through the configured codec"
+
+	RootCmd.AddCommand(&dlqCmd.Command)
+}
@@ -4,35 +4,191 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"runtime"
+	"time"
 
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/cfgtype"
+	"github.com/elastic/beats/libbeat/common/transport/tlscommon"
 )
 
 type Config struct {
-	Brokers           []string `config:"brokers"`
-	Topics            []string `config:"topics"`
-	ClientID          string   `config:"client_id"`
-	Group             string   `config:"group"`
-	Offset            string   `config:"offset"`
-	Codec             string   `config:"codec"`
-	PublishMode       string   `config:"publish_mode"`
-	ChannelBufferSize int      `config:"channel_buffer_size"`
-	ChannelWorkers    int      `config:"channel_workers"`
-	TimestampKey      string   `config:"timestamp_key"`
-	TimestampLayout   string   `config:"timestamp_layout"`
+	CodecConfig `config:",inline"` // codec, timestamp_*, protobuf, debezium and compacted
+
+	Brokers               []string             `config:"brokers"`
+	TLS                   *tlscommon.Config    `config:"ssl"`
+	Username              string               `config:"username"`
+	Password              string               `config:"password"`
+	SASL                  SASLConfig           `config:"sasl"`
+	Topics                []TopicConfig        `config:"topics"`
+	TopicsPattern         string               `config:"topics_pattern"`
+	TopicsExcludePattern  string               `config:"topics_exclude_pattern"`
+	TopicsRefreshInterval time.Duration        `config:"topics_refresh_interval"`
+	Mode                  string               `config:"mode"`
+	Partitions            map[string][]int32   `config:"partitions"`
+	RegistryFile          string               `config:"registry_file"`
+	RegistryFlush         time.Duration        `config:"registry_flush"`
+	ClientID              string               `config:"client_id"`
+	Version               string               `config:"version"`
+	Group                 string               `config:"group"`
+	Offset                string               `config:"offset"`
+	ForceInitialOffset    bool                 `config:"force_initial_offset"`
+	RunOnce               bool                 `config:"run_once"`
+	Until                 string               `config:"until"`
+	OnDecodeError         string               `config:"on_decode_error"`
+	DecodeErrorTag        string               `config:"decode_error_tag"`
+	PublishMode           string               `config:"publish_mode"`
+	ChannelBufferSize     int                  `config:"channel_buffer_size"`
+	ChannelWorkers        int                  `config:"channel_workers"`
+	Ordering              string               `config:"ordering"`
+	KafkaMetadata         string               `config:"kafka_metadata"`
+	KeyCodec              string               `config:"key_codec"`
+	KeyTarget             string               `config:"key_target"`
+	DocumentID            DocumentIDConfig     `config:"document_id"`
+	Headers               HeadersConfig        `config:"headers"`
+	ShutdownTimeout       time.Duration        `config:"shutdown_timeout"`
+	RebalanceDwellTime    time.Duration        `config:"rebalance_dwell_time"`
+	DeadLetter            DeadLetterConfig     `config:"dead_letter"`
+	SchemaRegistry        SchemaRegistryConfig `config:"schema_registry"`
 }
 
 var DefaultConfig = Config{
-	Brokers:           []string{"localhost:9092"},
-	Topics:            []string{"watch"},
-	ClientID:          "beat",
-	Group:             "kafkabeat",
-	Offset:            "newest",
-	Codec:             "json",
-	PublishMode:       "default",
-	ChannelBufferSize: 256,
-	ChannelWorkers:    runtime.NumCPU(),
-	TimestampKey:      "@timestamp",
-	TimestampLayout:   common.TsLayout,
+	CodecConfig: CodecConfig{
+		Codec:           "json",
+		TimestampKey:    "@timestamp",
+		TimestampLayout: common.TsLayout,
+		Protobuf:        ProtobufConfig{Int64AsString: true},
+	},
+
+	Brokers:               []string{"localhost:9092"},
+	SASL:                  SASLConfig{Mechanism: "PLAIN"},
+	Topics:                []TopicConfig{{Topic: "watch"}},
+	TopicsRefreshInterval: time.Minute,
+	Mode:                  "group",
+	RegistryFile:          "registry",
+	RegistryFlush:         time.Second,
+	ClientID:              "beat",
+	Version:               "0.9.0.0",
+	Group:                 "kafkabeat",
+	Offset:                "newest",
+	OnDecodeError:         "drop",
+	DecodeErrorTag:        "decode_error",
+	PublishMode:           "default",
+	ChannelBufferSize:     256,
+	ChannelWorkers:        runtime.NumCPU(),
+	Ordering:              "partition",
+	KafkaMetadata:         "none",
+	KeyTarget:             "kafka.key",
+	DocumentID:            DocumentIDConfig{Source: "none", Target: "@metadata.id"},
+	Headers:               HeadersConfig{Codec: "string"},
+	ShutdownTimeout:       5 * time.Second,
+	RebalanceDwellTime:    2 * time.Second,
+	DeadLetter: DeadLetterConfig{
+		File:       DeadLetterFileConfig{MaxSize: 10 * 1024 * 1024, MaxBackups: 7},
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+	},
+	SchemaRegistry: SchemaRegistryConfig{Timeout: 10 * time.Second},
+}
+
+// Codec and timestamp settings, global or topic specific
+type CodecConfig struct {
+	Codec           string         `config:"codec"`
+	TimestampKey    string         `config:"timestamp_key"`
+	TimestampLayout string         `config:"timestamp_layout"`
+	TimestampHeader string         `config:"timestamp_header"`
+	Protobuf        ProtobufConfig `config:"protobuf"`
+	Compacted       bool           `config:"compacted"`
+	Debezium        DebeziumConfig `config:"debezium"`
+}
+
+// Topic given either by name or as object with topic name or pattern and
+// topic specific settings
+type TopicConfig struct {
+	Topic    string
+	Pattern  string
+	Settings *common.Config // nil for topic given by name
+}
+
+func (t *TopicConfig) Unpack(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		t.Topic = v
+		return nil
+
+	case map[string]interface{}:
+		cfg, err := common.NewConfigFrom(v)
+		if err != nil {
+			return err
+		}
+		topic := struct {
+			Topic   string `config:"topic"`
+			Pattern string `config:"pattern"`
+		}{}
+		if err := cfg.Unpack(&topic); err != nil {
+			return err
+		}
+		if (topic.Topic == "") == (topic.Pattern == "") {
+			return errors.New("either topic or pattern must be set")
+		}
+		t.Topic, t.Pattern, t.Settings = topic.Topic, topic.Pattern, cfg
+		return nil
+
+	default:
+		return fmt.Errorf("invalid topic: %v", v)
+	}
+}
+
+type DebeziumConfig struct {
+	Deletes bool `config:"deletes"`
+}
+
+type SASLConfig struct {
+	Mechanism string `config:"mechanism"`
+}
+
+type HeadersConfig struct {
+	Include []string          `config:"include"`
+	Codec   string            `config:"codec"`
+	Codecs  map[string]string `config:"codecs"`
+	Target  string            `config:"target"`
+}
+
+type DocumentIDConfig struct {
+	Source string `config:"source"`
+	Field  string `config:"field"`
+	Hash   bool   `config:"hash"`
+	Target string `config:"target"`
+}
+
+type DeadLetterConfig struct {
+	Topic      string               `config:"topic"`
+	Brokers    []string             `config:"brokers"`
+	File       DeadLetterFileConfig `config:"file"`
+	Backoff    time.Duration        `config:"backoff"`
+	MaxBackoff time.Duration        `config:"max_backoff"`
+}
+
+type DeadLetterFileConfig struct {
+	Path       string           `config:"path"`
+	MaxSize    cfgtype.ByteSize `config:"max_size"`
+	MaxBackups uint             `config:"max_backups"`
+}
+
+type SchemaRegistryConfig struct {
+	URL      string            `config:"url"`
+	Username string            `config:"username"`
+	Password string            `config:"password"`
+	TLS      *tlscommon.Config `config:"ssl"`
+	Timeout  time.Duration     `config:"timeout"`
+}
+
+type ProtobufConfig struct {
+	DescriptorSet       string `config:"descriptor_set"`
+	MessageType         string `config:"message_type"`
+	ConfluentWireFormat bool   `config:"confluent_wire_format"`
+	Int64AsString       bool   `config:"int64_as_string"`
+	TimestampField      string `config:"timestamp_field"`
 }